@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"time"
+
+	rss "github.com/jteeuwen/go-pkg-rss"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ArchiveProgress is the download progress of a feed in archive mode
+type ArchiveProgress struct {
+	Feed       string    `json:"feed"`
+	Downloaded int       `json:"downloaded"`
+	Day        string    `json:"day,omitempty"`
+	DayCount   int       `json:"dayCount,omitempty"`
+	LastTitle  string    `json:"lastTitle,omitempty"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+func (s *StateStore) archiveProgress(feed string) ArchiveProgress {
+	progress := ArchiveProgress{Feed: feed}
+	if s == nil {
+		return progress
+	}
+	s.db.View(func(tx *bolt.Tx) error {
+		if value := tx.Bucket(archivesBucket).Get([]byte(feedKey(feed))); value != nil {
+			json.Unmarshal(value, &progress)
+		}
+		return nil
+	})
+	return progress
+}
+
+func (s *StateStore) putArchiveProgress(progress ArchiveProgress) {
+	if s == nil {
+		return
+	}
+	value, err := json.Marshal(progress)
+	if err == nil {
+		err = s.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(archivesBucket).Put([]byte(feedKey(progress.Feed)), value)
+		})
+	}
+	if err != nil {
+		logger.Warning.Println("Cannot record the archive progress of "+progress.Feed, err)
+	}
+}
+
+// itemKey is the sort key of a feed item, the position is the reversed feed order since the feeds list the newest items first
+type itemKey struct {
+	item      *rss.Item
+	season    int
+	episode   int
+	published time.Time
+	dated     bool
+	position  int
+}
+
+func itemKeys(items []*rss.Item) []itemKey {
+	keys := make([]itemKey, len(items))
+	for i, item := range items {
+		keys[i] = itemKey{item: item, position: len(items) - 1 - i}
+		keys[i].season, keys[i].episode = itemNumbers(item)
+		if published, err := item.ParsedPubDate(); err == nil {
+			keys[i].published, keys[i].dated = published, true
+		}
+	}
+	return keys
+}
+
+// olderThan orders the items by publication date, the items without date last, then by reversed feed order
+func (key itemKey) olderThan(other itemKey) bool {
+	if key.dated != other.dated {
+		return key.dated
+	}
+	if key.dated && !key.published.Equal(other.published) {
+		return key.published.Before(other.published)
+	}
+	return key.position < other.position
+}
+
+// sortItems sorts the items in the order of their keys
+func sortItems(keys []itemKey, less func(key itemKey, other itemKey) bool) []*rss.Item {
+	sort.Slice(keys, func(i, j int) bool { return less(keys[i], keys[j]) })
+	sorted := make([]*rss.Item, len(keys))
+	for i, key := range keys {
+		sorted[i] = key.item
+	}
+	return sorted
+}
+
+// oldestFirst sorts the feed items by publication date, the items without date come last in their reversed feed order
+func oldestFirst(items []*rss.Item) []*rss.Item {
+	return sortItems(itemKeys(items), itemKey.olderThan)
+}
+
+// archiveQuota is the number of episodes that can still be downloaded for the archive period
+func (podcast Podcast) archiveQuota(progress ArchiveProgress, today string) int {
+	limit := podcast.settings.ArchiveLimit
+	if limit <= 0 {
+		return -1
+	}
+	if podcast.settings.ArchivePeriod == "day" && progress.Day == today {
+		return limit - progress.DayCount
+	}
+	return limit
+}
+
+// fetchArchive downloads the whole feed oldest first, within the archive limit, the downloaded episodes are never removed.
+// The episode states make the archive resumable : the next run starts with the oldest episode not downloaded yet.
+func (podcast Podcast) fetchArchive(items []*rss.Item) {
+	today := time.Now().Format("2006-01-02")
+	progress := states.archiveProgress(podcast.subscription.URL)
+	quota := podcast.archiveQuota(progress, today)
+
+	var queued []*Episode
+	total := 0
+	for _, item := range oldestFirst(items) {
+		if isStopping() {
+			logger.Debug.Println("Stop requested, the remaining episodes are skipped : " + podcast.feedPodcast.Title)
+			break
+		}
+		episode := NewEpisode(item, &podcast)
+		if episode.enclosure == nil {
+			logger.Debug.Println("No enclosure selected for episode " + podcast.feedPodcast.Title + " - " + item.Title)
+			continue
+		}
+		if reason := podcast.settings.Filter.skipReason(episode); reason != "" {
+			logger.Debug.Println("Episode skipped : " + episode.String() + " (" + reason + ")")
+			continue
+		}
+		total++
+		states.record(episode, StatusSeen, "")
+		if states.isKnown(episode) || pathExists(episode.file()) {
+			if podcast.settings.RetagExisting {
+				podcast.wg.Add(1)
+				episodeTasks <- episode
+			}
+			continue
+		}
+		if quota >= 0 && len(queued) >= quota {
+			continue
+		}
+		queued = append(queued, episode)
+		podcast.wg.Add(1)
+		episodeTasks <- episode
+	}
+	logger.Debug.Println("Wait for all archive episodes to be processed : " + podcast.feedPodcast.Title)
+	podcast.wg.Wait()
+
+	downloaded := 0
+	for _, episode := range queued {
+		if states.isKnown(episode) || pathExists(episode.file()) {
+			downloaded++
+			progress.LastTitle = episode.feedEpisode.Title
+		}
+	}
+	if progress.Day != today {
+		progress.Day = today
+		progress.DayCount = 0
+	}
+	progress.DayCount += downloaded
+	progress.Downloaded += downloaded
+	progress.UpdatedAt = time.Now()
+	states.putArchiveProgress(progress)
+	logger.Info.Println("Archive of " + podcast.feedPodcast.Title + " : " + strconv.Itoa(downloaded) + " episodes downloaded, " +
+		strconv.Itoa(progress.Downloaded) + " since the start of the archive (" + strconv.Itoa(total) + " episodes in the feed)")
+	if progress.LastTitle != "" {
+		logger.Debug.Println("Last archived episode of " + podcast.feedPodcast.Title + " : " + progress.LastTitle)
+	}
+}
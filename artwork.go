@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+
+	"github.com/spf13/viper"
+)
+
+// Artwork is the cover embedded into an episode file
+type Artwork struct {
+	MediaType string
+	Width     int
+	Height    int
+	Content   []byte
+}
+
+// episodeArtwork is the episode itunes:image, the podcast cover when the episode has none
+func episodeArtwork(episode *Episode) (*Artwork, error) {
+	var content []byte
+	if uri := episode.image(); uri != "" {
+		var err error
+		if content, _, err = fetchResource(uri, episode.Podcast.client); err != nil {
+			logger.Debug.Println("Episode image ignored : "+uri, err)
+			content = nil
+		}
+	}
+	if content == nil {
+		var err error
+		if content, err = ioutil.ReadFile(episode.Podcast.convertedImage()); err != nil {
+			return nil, err
+		}
+	}
+	return newArtwork(content, viper.GetInt("artworkSize"))
+}
+
+// newArtwork scales the image down to the max size, a small enough jpeg or png image is kept unchanged
+func newArtwork(content []byte, maxSize int) (*Artwork, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	if (format == "jpeg" || format == "png") && (maxSize <= 0 || config.Width <= maxSize && config.Height <= maxSize) {
+		return &Artwork{MediaType: "image/" + format, Width: config.Width, Height: config.Height, Content: content}, nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	img = ResizeImage(img, maxSize)
+	var buffer bytes.Buffer
+	if err = jpeg.Encode(&buffer, img, &jpeg.Options{Quality: 90}); err != nil {
+		return nil, err
+	}
+	return &Artwork{MediaType: "image/jpeg", Width: img.Bounds().Dx(), Height: img.Bounds().Dy(), Content: buffer.Bytes()}, nil
+}
@@ -3,15 +3,11 @@ package main
 
 import (
 	"fmt"
-	"io"
-	"io/ioutil"
-	"math"
 	"net/http"
 	"os"
 	"os/user"
 	"path/filepath"
 	"strconv"
-	"strings"
 	"sync"
 
 	rss "github.com/jteeuwen/go-pkg-rss"
@@ -20,25 +16,26 @@ import (
 )
 
 var (
-	logger           Logger
-	feedWg           sync.WaitGroup
-	targetFolder     string
-	feedsPath        string
-	maxEpisodes      int
-	keptEpisodes     int
-	verbose          bool
-	maxFeedRunner    int
-	maxImageRunner   int
-	maxEpisodeRunner int
-	maxRetryDownload int
-	episodeTasks     chan *Episode
-	feedTasks        chan string
-	newEpisodes      chan string
-	rootCmd          *cobra.Command
-	httpClient       *http.Client
-	maxCommentSize   int
-	retagExisting    bool
-	dateFormat       string
+	logger            Logger
+	feedWg            sync.WaitGroup
+	targetFolder      string
+	feedsPath         string
+	maxEpisodes       int
+	keptEpisodes      int
+	verbose           bool
+	maxFeedRunner     int
+	maxImageRunner    int
+	maxEpisodeRunner  int
+	maxRetryDownload  int
+	episodeTasks      chan *Episode
+	feedTasks         chan *Subscription
+	newEpisodes       chan string
+	rootCmd           *cobra.Command
+	httpClient        *http.Client
+	maxCommentSize    int
+	retagExisting     bool
+	dateFormat        string
+	validateDownloads bool
 )
 
 type episodeTask struct {
@@ -48,7 +45,7 @@ type episodeTask struct {
 	channel           *rss.Channel
 }
 
-func fetchPodcasts() {
+func loadSettings() {
 
 	targetFolder = viper.GetString("directory")
 	feedsPath = viper.GetString("feeds")
@@ -61,27 +58,48 @@ func fetchPodcasts() {
 	maxCommentSize = viper.GetInt("maxCommentSize")
 	retagExisting = viper.GetBool("retagExisting")
 	dateFormat = viper.GetString("dateFormat")
-	keptEpisodes = int(math.Max(float64(viper.GetInt("keptEpisodes")), float64(maxEpisodes)))
+	validateDownloads = viper.GetBool("validateDownloads")
+	keptEpisodes = keptEpisodesCount(viper.GetInt("keptEpisodes"))
 
 	logger = NewLogger(verbose)
-	logger.Info.Println("Podcast Update")
+	httpClient = &http.Client{}
 
 	if verbose {
 		viper.Debug()
 		rootCmd.DebugFlags()
 	}
+}
+
+func fetchPodcasts() {
+
+	logger.Info.Println("Podcast Update")
+
+	feeds, err := parseFeeds(feedsPath)
+	if err != nil {
+		logger.Error.Println("Cannot parse feed file : ", err)
+	}
+	fetchFeeds(feeds)
+	logger.Info.Println("Podcasts Updated")
+}
+
+// fetchFeeds downloads the new episodes of the feeds and waits for all of them to be processed
+func fetchFeeds(feeds []Subscription) {
 
 	err := os.MkdirAll(targetFolder, 0777)
 	if err != nil {
 		logger.Error.Panic("Cannot create the target folder : "+targetFolder+" : ", err)
 	}
 
+	states, err = OpenStateStore(stateDatabasePath())
+	if err != nil {
+		logger.Error.Println("Cannot open the state database, episodes are only checked against the library files : ", err)
+	}
+	defer states.Close()
+
 	episodeTasks = make(chan *Episode)
-	feedTasks = make(chan string)
+	feedTasks = make(chan *Subscription)
 	newEpisodes = make(chan string, 1000)
 
-	httpClient = &http.Client{}
-
 	for i := 0; i < maxFeedRunner; i++ {
 		feedWg.Add(1)
 		go func() {
@@ -100,48 +118,42 @@ func fetchPodcasts() {
 		}()
 	}
 
-	feeds, err := parseFeeds(feedsPath)
 	logger.Debug.Println("Feeds : ", feeds)
-	if err == nil {
-		for _, feed := range feeds {
-			feedTasks <- feed
+	for i := range feeds {
+		if isStopping() {
+			logger.Info.Println("Stop requested, the remaining feeds are skipped")
+			break
 		}
-	} else {
-		logger.Error.Println("Cannot parse feed file : ", err)
+		feedTasks <- &feeds[i]
 	}
 	close(feedTasks)
 	logger.Debug.Println("Wait for all feeds to be processed ...")
 	feedWg.Wait()
 	close(episodeTasks)
 	close(newEpisodes)
+	removeLibraryOverflow(false)
+	purgeTrash()
 	processNewEpisodes()
-	logger.Info.Println("Podcasts Updated")
 }
 
 func processNewEpisodes() {
 
-	if len(newEpisodes) > 0 {
-
-		filename := filepath.Join(targetFolder, "last-episodes.m3u")
-		file, err := os.Create(filename)
-		if err != nil {
-			logger.Error.Println("Cannot write the new episode file ", err)
-			return
+	var episodeFiles []string
+	for newEpisode := range newEpisodes {
+		if pathExists(newEpisode) {
+			episodeFiles = append(episodeFiles, newEpisode)
+		} else {
+			logger.Error.Println("Non existing new episode path : " + newEpisode)
 		}
-		defer file.Close()
-
-		logger.Debug.Println("Write the new episode file ", filename)
+	}
 
-		for newEpisode := range newEpisodes {
-			if pathExists(newEpisode) {
-				logger.Debug.Println("new episode added to playlist", newEpisode)
-				io.WriteString(file, newEpisode+"\n")
-			} else {
-				logger.Error.Println("Non existing new episode path : " + newEpisode)
-			}
-		}
-		logger.Debug.Println("Last episode playlist written")
+	if len(episodeFiles) > 0 {
+		logger.Debug.Println("Write the new episode playlists")
+		writePlaylists(filepath.Join(targetFolder, LastEpisodesPlaylist), playlistEntries(episodeFiles))
 	}
+	writePodcastPlaylists()
+
+	updateMPD(episodeFiles)
 }
 
 func main() {
@@ -150,23 +162,44 @@ func main() {
 		Use:   "blackpodder",
 		Short: "Blackpodder is a podcast fetcher",
 		Long:  `Blackpodder is a podcast fetcher written in GO`,
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			loadSettings()
+		},
 		Run: func(cmd *cobra.Command, args []string) {
 			fetchPodcasts()
 		},
 	}
+	rootCmd.AddCommand(newImportOPMLCmd(), newExportOPMLCmd(), newFeedsCmd(), newStateCmd(), newDaemonCmd(), newCleanCmd(), newTrashCmd(), newRenameCmd())
+	logger = NewLogger(false)
 	readConfig()
 	rootCmd.Execute()
 }
 
-func downloadFeed(url string) {
-	logger.Debug.Println("Downloading feed ", url)
-	PollFeed(url, 5, charsetReader)
+func downloadFeed(subscription *Subscription) {
+	logger.Debug.Println("Downloading feed ", subscription.URL)
+	schedule, handled := PollFeed(subscription.URL, subscription.client(), 5, charsetReader, func(feed *rss.Feed, ch *rss.Channel, newitems []*rss.Item) bool {
+		return itemHandler(subscription, feed, ch, newitems)
+	}, subscription.replaysUnchangedFeed())
+	if !handled {
+		removeFeedOldEpisodes(subscription)
+	}
+	scheduler.polled(subscription, schedule)
 }
 
-func itemHandler(feed *rss.Feed, ch *rss.Channel, newitems []*rss.Item) {
+func itemHandler(subscription *Subscription, feed *rss.Feed, ch *rss.Channel, newitems []*rss.Item) bool {
 
 	logger.Debug.Println(strconv.Itoa(len(newitems)) + " available episodes for " + ch.Title)
 	logger.Debug.Println("Channel : ", ch)
+	if ch.Title == "" {
+		completeChannelTitle(feed, ch)
+		logger.Warning.Println("Missing podcast title in the feed, this replacement will be used : " + ch.Title)
+	}
+
+	podcast := NewPodcast(targetFolder, ch, subscription)
+	return podcast.fetchNewEpisodes(newitems)
+}
+
+func completeChannelTitle(feed *rss.Feed, ch *rss.Channel) {
 	if ch.Title == "" {
 		if ch.Author.Name != "" {
 			ch.Title = ch.Author.Name
@@ -175,35 +208,26 @@ func itemHandler(feed *rss.Feed, ch *rss.Channel, newitems []*rss.Item) {
 		} else {
 			ch.Title = extractResourceNameFromURL(feed.Url)
 		}
-
-		logger.Warning.Println("Missing podcast title in the feed, this replacement will be used : " + ch.Title)
-
 	}
-
-	podcast := NewPodcast(targetFolder, ch)
-	podcast.fetchNewEpisodes(newitems)
 }
 
 func chanHandler(feed *rss.Feed, newchannels []*rss.Channel) {
 }
 
-func parseFeeds(filePath string) ([]string, error) {
-	var lines []string
-	var filteredLines []string
-	content, err := ioutil.ReadFile(filePath)
+func parseFeeds(filePath string) ([]Subscription, error) {
+	var feeds []Subscription
+	subscriptions, err := parseSubscriptions(filePath)
 	if err == nil {
-		lines = strings.Split(string(content), "\n")
-		lines = lines[:len(lines)-1]
-
-		for _, line := range lines {
-			line = strings.TrimSpace(line)
-			if !strings.HasPrefix(line, "#") {
-				filteredLines = append(filteredLines, line)
+		for _, subscription := range subscriptions {
+			if subscription.Disabled {
+				logger.Debug.Println("Disabled feed : ", subscription.URL)
+				continue
 			}
+			feeds = append(feeds, subscription)
 		}
-		logger.Info.Println(strconv.Itoa(len(filteredLines)) + " Podcasts found in the configuration")
+		logger.Info.Println(strconv.Itoa(len(feeds)) + " Podcasts found in the configuration")
 	}
-	return filteredLines, err
+	return feeds, err
 
 }
 
@@ -217,7 +241,7 @@ func readConfig() {
 
 	addProperty("feeds", "f", filepath.Join(configFolder, "feeds.dev"), "Feed file path")
 	addProperty("directory", "d", "/tmp/test-podcasts", "Podcast folder path")
-	addProperty("episodes", "e", 3, "Max episodes to download")
+	addProperty("episodes", "e", 3, "Max episodes to download (0 means all episodes)")
 	addProperty("verbose", "v", false, "Enable verbose mode")
 	addProperty("maxFeedRunner", "g", 5, "Max runners to fetch feeds")
 	addProperty("maxImageRunner", "i", 3, "Max runners to fetch images")
@@ -227,6 +251,46 @@ func readConfig() {
 	addProperty("retagExisting", "r", false, "Retag existing episodes")
 	addProperty("dateFormat", "m", "020106", "Date format to be used in tags based on this reference date : Mon Jan _2 15:04:05 2006")
 	addProperty("keptEpisodes", "n", 3, "Number of episodes to keep (0 or -1 means no old episode remval)")
+	addProperty("keepAge", "", "", "Remove the episodes published before this age (30d, 720h), empty means no age limit")
+	addProperty("maxPodcastSize", "", "", "Max size of each podcast folder (500M, 2G), the oldest episodes are removed first")
+	addProperty("maxLibrarySize", "", "", "Max size of the whole podcast folder (50G), the oldest episodes are removed first")
+	addProperty("archiveLimit", "", 5, "Max episodes downloaded by archive period for the feeds in archive mode (0 means no limit)")
+	addProperty("archivePeriod", "", "run", "Archive limit period : run or day")
+	addProperty("serialWindow", "", 3, "Number of unplayed episodes kept in advance for the serial podcasts")
+	addProperty("enclosureMode", "", "audio", "Downloaded enclosures : audio, video or any")
+	addProperty("mediaTypes", "", "", "Preferred enclosure media types, the first one first (audio/opus > audio/mpeg > video/mp4)")
+	addProperty("maxEnclosureSize", "", "", "Max enclosure size (200M), the larger enclosures are ignored")
+	addProperty("maxBitrate", "", 0, "Max enclosure bitrate in kbit/s (0 means no limit)")
+	addProperty("trashRetention", "", "30d", "Age after which the removed episodes are purged from the trash (0 means never)")
+	addProperty("chapters", "", true, "Embed the episode chapters into the mp3 files, other files get .chapters.json and .cue sidecar files")
+	addProperty("transcripts", "", true, "Download the episode transcripts next to the episode files as .srt and .lrc files")
+	addProperty("transcriptTags", "", false, "Embed the episode transcripts into the mp3 files as USLT and SYLT frames")
+	addProperty("embedArtwork", "", false, "Embed the episode artwork (the podcast cover when the episode has none) into the episode files")
+	addProperty("titleTemplate", "", defaultTagTemplates[TagTitle], "Episode title tag template (Go text/template with the episode fields)")
+	addProperty("artistTemplate", "", defaultTagTemplates[TagArtist], "Artist tag template")
+	addProperty("albumTemplate", "", defaultTagTemplates[TagAlbum], "Album tag template")
+	addProperty("albumArtistTemplate", "", defaultTagTemplates[TagAlbumArtist], "Album artist tag template")
+	addProperty("genreTemplate", "", defaultTagTemplates[TagGenre], "Genre tag template")
+	addProperty("commentTemplate", "", defaultTagTemplates[TagComment], "Comment tag template")
+	addProperty("descriptionTemplate", "", defaultTagTemplates[TagDescription], "Full description tag template")
+	addProperty("folderTemplate", "", "", "Podcast folder name template (Go text/template), empty means the podcast title")
+	addProperty("fileTemplate", "", "", "Episode path template in the podcast folder (Go text/template), empty means blp-<yymmdd>-<url file name>")
+	addProperty("artworkSize", "", 600, "Max width and height in pixels of the embedded artwork, larger images are scaled down (0 means no limit)")
+	addProperty("stateDatabase", "s", "", "Episode state database path (.blackpodder.db in the podcast folder by default)")
+	addProperty("feedCache", "", "", "Feed cache folder (.feeds in the podcast folder by default)")
+	addProperty("validateDownloads", "", true, "Check the downloaded episodes (http status, content type, size, audio format) before accepting them")
+	addProperty("pollInterval", "", "1h", "Daemon polling interval of the feeds without update hints")
+	addProperty("minPollInterval", "", "15m", "Daemon minimum polling interval of a feed")
+	addProperty("maxPollInterval", "", "24h", "Daemon maximum polling interval of a feed")
+	addProperty("pollJitter", "", "5m", "Daemon random delay added to the polling interval")
+	addProperty("playlistFormats", "", "m3u8", "Comma separated playlist formats : m3u8, xspf, pls")
+	addProperty("mpdHost", "", "", "MPD host or socket path, the MPD database and playlists are updated after each run when set")
+	addProperty("mpdPort", "", 6600, "MPD port")
+	addProperty("mpdPassword", "", "", "MPD password")
+	addProperty("mpdMusicDirectory", "", "", "Local path of the MPD music directory (the podcast folder by default)")
+	addProperty("mpdNewPlaylist", "", "new podcasts", "MPD stored playlist of the new episodes")
+	addProperty("mpdQueue", "", false, "Append the new episodes to the MPD queue")
+	addProperty("mpdUpdateTimeout", "", "5m", "Max wait for the MPD database update")
 
 	err := viper.ReadInConfig()
 	if err != nil {
@@ -237,16 +301,16 @@ func readConfig() {
 func addProperty(name string, short string, defaultValue interface{}, description string) {
 
 	if typeValue, ok := defaultValue.(int); ok {
-		rootCmd.Flags().IntP(name, short, typeValue, description)
+		rootCmd.PersistentFlags().IntP(name, short, typeValue, description)
 	} else if typeValue, ok := defaultValue.(string); ok {
-		rootCmd.Flags().StringP(name, short, typeValue, description)
+		rootCmd.PersistentFlags().StringP(name, short, typeValue, description)
 	} else if typeValue, ok := defaultValue.(bool); ok {
-		rootCmd.Flags().BoolP(name, short, typeValue, description)
+		rootCmd.PersistentFlags().BoolP(name, short, typeValue, description)
 	} else {
 		fmt.Println("Unknwown Property type will be ignored ", name)
 		return
 	}
 	viper.SetDefault(name, defaultValue)
-	viper.BindPFlag(name, rootCmd.Flags().Lookup(name))
+	viper.BindPFlag(name, rootCmd.PersistentFlags().Lookup(name))
 
 }
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// PodloveChaptersNamespace is the Podlove Simple Chapters namespace
+const PodloveChaptersNamespace string = "http://podlove.org/simple-chapters"
+
+// ChaptersVersion is the version of the JSON chapters format written in the sidecar files
+const ChaptersVersion string = "1.2.0"
+
+// ChaptersSuffix is the suffix of the JSON chapters sidecar file
+const ChaptersSuffix string = ".chapters.json"
+
+// CueSuffix is the suffix of the cue sheet sidecar file
+const CueSuffix string = ".cue"
+
+// MaxResourceSize is the maximum size of a resource downloaded in memory : chapters, transcript or artwork
+const MaxResourceSize int64 = 16 * 1024 * 1024
+
+// Chapter is an episode chapter of the JSON chapters format, the times are in seconds
+type Chapter struct {
+	StartTime float64 `json:"startTime"`
+	EndTime   float64 `json:"endTime,omitempty"`
+	Title     string  `json:"title,omitempty"`
+	Image     string  `json:"img,omitempty"`
+	URL       string  `json:"url,omitempty"`
+	TOC       *bool   `json:"toc,omitempty"`
+}
+
+// Chapters is the JSON chapters file of the podcast namespace
+type Chapters struct {
+	Version  string    `json:"version"`
+	Chapters []Chapter `json:"chapters"`
+}
+
+// episodeChapters reads the chapters of the episode, from the podcast:chapters file first then from the inline Podlove Simple Chapters.
+// The chapters are nil when the episode has none.
+func episodeChapters(episode *Episode) (*Chapters, error) {
+	if link := episode.podcasting.Chapters; link != nil {
+		if link.Type != "" && !strings.Contains(link.Type, "json") {
+			logger.Debug.Println("Unsupported chapters type ignored : " + link.Type + " " + link.URL)
+		} else {
+			return downloadChapters(link.URL, episode.Podcast.client)
+		}
+	}
+	return podloveChapters(episode), nil
+}
+
+func downloadChapters(uri string, client *http.Client) (*Chapters, error) {
+	content, _, err := fetchResource(uri, client)
+	if err != nil {
+		return nil, err
+	}
+	var chapters Chapters
+	if err = json.Unmarshal(content, &chapters); err != nil {
+		return nil, err
+	}
+	var listed []Chapter
+	for _, chapter := range chapters.Chapters {
+		if chapter.TOC == nil || *chapter.TOC {
+			listed = append(listed, chapter)
+		}
+	}
+	chapters.Chapters = listed
+	return &chapters, nil
+}
+
+// podloveChapters reads the psc:chapters of the feed item
+func podloveChapters(episode *Episode) *Chapters {
+	elements := episode.feedEpisode.Extensions[PodloveChaptersNamespace]["chapters"]
+	if len(elements) == 0 {
+		return nil
+	}
+	chapters := &Chapters{Version: ChaptersVersion}
+	for _, element := range elements[0].Childrens["chapter"] {
+		start, ok := parseClockTime(element.Attrs["start"])
+		if !ok {
+			logger.Debug.Println("Invalid chapter start ignored : " + element.Attrs["start"] + " " + episode.String())
+			continue
+		}
+		chapters.Chapters = append(chapters.Chapters, Chapter{
+			StartTime: start,
+			Title:     element.Attrs["title"],
+			URL:       element.Attrs["href"],
+			Image:     element.Attrs["image"],
+		})
+	}
+	return chapters
+}
+
+// complete sorts the chapters and sets the missing end times, the last chapter ends with the episode
+func (chapters *Chapters) complete(length time.Duration) {
+	chapters.Version = ChaptersVersion
+	sort.SliceStable(chapters.Chapters, func(i, j int) bool {
+		return chapters.Chapters[i].StartTime < chapters.Chapters[j].StartTime
+	})
+	for i := range chapters.Chapters {
+		chapter := &chapters.Chapters[i]
+		if chapter.EndTime > chapter.StartTime {
+			continue
+		}
+		if i+1 < len(chapters.Chapters) {
+			chapter.EndTime = chapters.Chapters[i+1].StartTime
+		} else if length.Seconds() > chapter.StartTime {
+			chapter.EndTime = length.Seconds()
+		}
+	}
+}
+
+// fetchResource downloads a small resource in memory with its media type
+func fetchResource(uri string, client *http.Client) (content []byte, mediaType string, err error) {
+	response, err := client.Get(uri)
+	if err != nil {
+		return nil, "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, "", errors.New("Unexpected status " + response.Status + " for " + uri)
+	}
+	content, err = ioutil.ReadAll(io.LimitReader(response.Body, MaxResourceSize+1))
+	if err == nil && int64(len(content)) > MaxResourceSize {
+		err = errors.New("Resource too large : " + uri)
+	}
+	mediaType, _, _ = mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if mediaType == "" || mediaType == "application/octet-stream" {
+		mediaType = http.DetectContentType(content)
+	}
+	return content, mediaType, err
+}
+
+// writeChapters adds the episode chapters to the ID3v2 tag of a mp3 file as CHAP/CTOC frames, saved with the other tags,
+// the other files get a JSON chapters and a cue sheet sidecar file
+func writeChapters(episode *Episode, tag tagFile, length time.Duration) {
+	if !viper.GetBool("chapters") {
+		return
+	}
+	chapters, err := episodeChapters(episode)
+	if err != nil {
+		logger.Warning.Println("Cannot read the chapters of "+episode.String(), err)
+		return
+	}
+	if chapters == nil || len(chapters.Chapters) == 0 {
+		return
+	}
+	if length == 0 {
+		length = episode.duration()
+	}
+	chapters.complete(length)
+	file := episode.file()
+	if id3, ok := tag.(*id3File); ok && strings.EqualFold(filepath.Ext(file), ".mp3") {
+		setID3Chapters(id3.tag, episode, chapters.Chapters)
+	} else {
+		err = writeChapterSidecars(file, episode, chapters)
+	}
+	if err != nil {
+		logger.Warning.Println("Cannot write the chapters of "+episode.String(), err)
+		return
+	}
+	logger.Debug.Println(strconv.Itoa(len(chapters.Chapters)) + " chapters written for " + episode.String())
+}
+
+// chapterImage is a downloaded chapter image
+type chapterImage struct {
+	mediaType string
+	content   []byte
+}
+
+// setID3Chapters replaces the CHAP and CTOC frames of the ID3v2 tag
+func setID3Chapters(tag *id3Tag, episode *Episode, chapters []Chapter) {
+	images := map[string]*chapterImage{}
+	for _, chapter := range chapters {
+		if _, found := images[chapter.Image]; found || chapter.Image == "" {
+			continue
+		}
+		content, mediaType, err := fetchResource(chapter.Image, episode.Podcast.client)
+		if err != nil || !strings.HasPrefix(mediaType, "image/") {
+			logger.Debug.Println("Chapter image ignored : "+chapter.Image, err)
+			images[chapter.Image] = nil
+			continue
+		}
+		images[chapter.Image] = &chapterImage{mediaType: mediaType, content: content}
+	}
+	tag.removeFrames("CHAP", "CTOC")
+	var elementIDs []string
+	for i, chapter := range chapters {
+		elementID := "chp" + strconv.Itoa(i)
+		elementIDs = append(elementIDs, elementID)
+		var subframes []id3Frame
+		if chapter.Title != "" {
+			subframes = append(subframes, id3Frame{ID: "TIT2", Data: tag.encodeText(chapter.Title)})
+		}
+		if chapter.URL != "" {
+			data := append([]byte{tag.textEncoding()}, tag.encodeString("", true)...)
+			subframes = append(subframes, id3Frame{ID: "WXXX", Data: append(data, chapter.URL...)})
+		}
+		if image := images[chapter.Image]; image != nil {
+			subframes = append(subframes, id3Frame{ID: "APIC", Data: tag.encodePicture(image.mediaType, 0, image.content)})
+		}
+		data := append([]byte(elementID), 0)
+		times := make([]byte, 16)
+		binary.BigEndian.PutUint32(times, uint32(chapter.StartTime*1000))
+		binary.BigEndian.PutUint32(times[4:], uint32(chapter.EndTime*1000))
+		binary.BigEndian.PutUint32(times[8:], 0xffffffff)
+		binary.BigEndian.PutUint32(times[12:], 0xffffffff)
+		data = append(data, times...)
+		tag.addFrame("CHAP", append(data, tag.encodeFrames(subframes)...))
+	}
+	toc := append([]byte("toc"), 0, 0x03, byte(len(elementIDs)))
+	for _, elementID := range elementIDs {
+		toc = append(append(toc, elementID...), 0)
+	}
+	toc = append(toc, tag.encodeFrames([]id3Frame{{ID: "TIT2", Data: tag.encodeText(episode.feedEpisode.Title)}})...)
+	tag.addFrame("CTOC", toc)
+}
+
+// writeChapterSidecars writes the chapters next to the episode file as JSON chapters and as a cue sheet
+func writeChapterSidecars(file string, episode *Episode, chapters *Chapters) error {
+	content, err := json.MarshalIndent(chapters, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(sidecarPath(file, ChaptersSuffix), content); err != nil {
+		return err
+	}
+	return writeFileAtomic(sidecarPath(file, CueSuffix), []byte(cueSheet(file, episode, chapters.Chapters)))
+}
+
+func cueString(value string) string {
+	return "\"" + strings.Replace(strings.Join(strings.Fields(value), " "), "\"", "'", -1) + "\""
+}
+
+// cueTime formats a time in seconds as the MM:SS:FF cue sheet index, with 75 frames per second
+func cueTime(seconds float64) string {
+	frames := int(seconds * 75)
+	return fmt.Sprintf("%02d:%02d:%02d", frames/75/60, frames/75%60, frames%75)
+}
+
+func cueSheet(file string, episode *Episode, chapters []Chapter) string {
+	fileType := "WAVE"
+	if strings.EqualFold(filepath.Ext(file), ".mp3") {
+		fileType = "MP3"
+	}
+	lines := []string{
+		"PERFORMER " + cueString(episode.Podcast.feedPodcast.Title),
+		"TITLE " + cueString(episode.feedEpisode.Title),
+		"FILE " + cueString(filepath.Base(file)) + " " + fileType,
+	}
+	for i, chapter := range chapters {
+		lines = append(lines,
+			fmt.Sprintf("  TRACK %02d AUDIO", i+1),
+			"    TITLE "+cueString(chapter.Title),
+			"    PERFORMER "+cueString(episode.Podcast.feedPodcast.Title),
+			"    INDEX 01 "+cueTime(chapter.StartTime))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"math/rand"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	rss "github.com/jteeuwen/go-pkg-rss"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// SyndicationNamespace is the RSS 1.0 syndication module namespace (sy:updatePeriod, sy:updateFrequency)
+const SyndicationNamespace string = "http://purl.org/rss/1.0/modules/syndication/"
+
+// FeedSchedule holds the update hints of a feed
+type FeedSchedule struct {
+	TTL             int    `json:"ttl,omitempty"`
+	SkipHours       []int  `json:"skipHours,omitempty"`
+	SkipDays        []int  `json:"skipDays,omitempty"`
+	UpdatePeriod    string `json:"updatePeriod,omitempty"`
+	UpdateFrequency int    `json:"updateFrequency,omitempty"`
+}
+
+// NewFeedSchedule reads the update hints of the feed channel
+func NewFeedSchedule(ch *rss.Channel) FeedSchedule {
+	schedule := FeedSchedule{
+		TTL:       ch.TTL,
+		SkipHours: ch.SkipHours,
+		SkipDays:  ch.SkipDays,
+	}
+	if extensions, ok := ch.Extensions[SyndicationNamespace]; ok {
+		if values := extensions["updatePeriod"]; len(values) > 0 {
+			schedule.UpdatePeriod = strings.ToLower(strings.TrimSpace(values[0].Value))
+		}
+		if values := extensions["updateFrequency"]; len(values) > 0 {
+			schedule.UpdateFrequency, _ = strconv.Atoi(strings.TrimSpace(values[0].Value))
+		}
+	}
+	return schedule
+}
+
+// interval is the polling interval announced by the feed, 0 when the feed has no hint
+func (s FeedSchedule) interval() time.Duration {
+	var interval time.Duration
+	if s.TTL > 0 {
+		interval = time.Duration(s.TTL) * time.Minute
+	}
+	periods := map[string]time.Duration{
+		"hourly":  time.Hour,
+		"daily":   24 * time.Hour,
+		"weekly":  7 * 24 * time.Hour,
+		"monthly": 30 * 24 * time.Hour,
+		"yearly":  365 * 24 * time.Hour,
+	}
+	if period, ok := periods[s.UpdatePeriod]; ok {
+		frequency := s.UpdateFrequency
+		if frequency <= 0 {
+			frequency = 1
+		}
+		if updateInterval := period / time.Duration(frequency); updateInterval > interval {
+			interval = updateInterval
+		}
+	}
+	return interval
+}
+
+// skipped tells if the feed should not be polled at the given time according to skipHours (GMT) and skipDays
+func (s FeedSchedule) skipped(t time.Time) bool {
+	t = t.UTC()
+	for _, hour := range s.SkipHours {
+		if hour == t.Hour() {
+			return true
+		}
+	}
+	for _, day := range s.SkipDays {
+		if time.Weekday(day%7) == t.Weekday() {
+			return true
+		}
+	}
+	return false
+}
+
+// nextPoll computes the next polling time of the feed, within the configured minimum and maximum intervals
+func (s FeedSchedule) nextPoll(from time.Time) time.Time {
+	minInterval := viper.GetDuration("minPollInterval")
+	maxInterval := viper.GetDuration("maxPollInterval")
+	interval := s.interval()
+	if interval == 0 {
+		interval = viper.GetDuration("pollInterval")
+	}
+	if interval < minInterval {
+		interval = minInterval
+	}
+	if maxInterval > 0 && interval > maxInterval {
+		interval = maxInterval
+	}
+	if jitter := viper.GetDuration("pollJitter"); jitter > 0 {
+		interval += time.Duration(rand.Int63n(int64(jitter)))
+	}
+	next := from.Add(interval)
+	limit := from.Add(interval + maxInterval)
+	for s.skipped(next) && next.Before(limit) {
+		next = next.Truncate(time.Hour).Add(time.Hour)
+	}
+	return next
+}
+
+// Scheduler keeps the next polling time of each feed
+type Scheduler struct {
+	mutex     sync.Mutex
+	nextPolls map[string]time.Time
+}
+
+var scheduler *Scheduler
+
+// NewScheduler makes a new scheduler, all the feeds are due at first
+func NewScheduler() *Scheduler {
+	return &Scheduler{nextPolls: make(map[string]time.Time)}
+}
+
+func (s *Scheduler) polled(subscription *Subscription, schedule FeedSchedule) {
+	if s == nil {
+		return
+	}
+	next := schedule.nextPoll(time.Now())
+	logger.Debug.Println("Next poll of " + subscription.URL + " : " + next.Format(time.RFC3339))
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.nextPolls[feedKey(subscription.URL)] = next
+}
+
+// due returns the feeds to be polled now and the time of the next poll
+func (s *Scheduler) due(feeds []Subscription, now time.Time) (due []Subscription, next time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, feed := range feeds {
+		poll, known := s.nextPolls[feedKey(feed.URL)]
+		if !known || !poll.After(now) {
+			due = append(due, feed)
+			continue
+		}
+		if next.IsZero() || poll.Before(next) {
+			next = poll
+		}
+	}
+	return due, next
+}
+
+var stopping int32
+
+func isStopping() bool {
+	return atomic.LoadInt32(&stopping) == 1
+}
+
+func newDaemonCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "daemon",
+		Short: "Keep running and poll each feed on its own schedule",
+		Long: `Keep running and poll each feed according to its update hints (ttl, skipHours, skipDays, sy:updatePeriod).
+SIGTERM and SIGINT stop the daemon once the in-flight downloads are finished (a second signal stops it at once,
+the partial downloads are resumed at the next start), SIGHUP reloads the configuration.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			runDaemon()
+		},
+	}
+}
+
+func runDaemon() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	scheduler = NewScheduler()
+	logger.Info.Println("Podcast daemon started")
+
+	reloadRequested := false
+	for !isStopping() {
+		if reloadRequested {
+			reloadConfig()
+			reloadRequested = false
+		}
+		feeds, err := parseFeeds(feedsPath)
+		if err != nil {
+			logger.Error.Println("Cannot parse feed file : ", err)
+		}
+		due, next := scheduler.due(feeds, time.Now())
+
+		if len(due) > 0 {
+			logger.Info.Println(strconv.Itoa(len(due)) + " feeds to update")
+			done := make(chan bool)
+			go func() {
+				defer close(done)
+				fetchFeeds(due)
+			}()
+			for running := true; running; {
+				select {
+				case <-done:
+					running = false
+				case sig := <-signals:
+					reloadRequested = handleDaemonSignal(sig) || reloadRequested
+				}
+			}
+			logger.Info.Println("Podcasts Updated")
+			continue
+		}
+
+		wait := viper.GetDuration("pollInterval")
+		if !next.IsZero() {
+			wait = time.Until(next)
+		}
+		logger.Debug.Println("Next feed update in " + wait.String())
+		select {
+		case <-time.After(wait):
+		case sig := <-signals:
+			reloadRequested = handleDaemonSignal(sig)
+		}
+	}
+	logger.Info.Println("Podcast daemon stopped")
+}
+
+// handleDaemonSignal tells if the configuration has to be reloaded, it is reloaded once the running update is finished
+func handleDaemonSignal(sig os.Signal) (reload bool) {
+	if sig == syscall.SIGHUP {
+		logger.Info.Println("Configuration reload requested")
+		return true
+	}
+	if isStopping() {
+		logger.Warning.Println("Immediate stop, the partial downloads will be resumed at the next start")
+		os.Exit(1)
+	}
+	logger.Info.Println("Stop requested, waiting for the in-flight downloads")
+	atomic.StoreInt32(&stopping, 1)
+	return false
+}
+
+func reloadConfig() {
+	if err := viper.ReadInConfig(); err != nil {
+		logger.Error.Println("Cannot reload the configuration : ", err)
+	}
+	loadSettings()
+	logger.Info.Println("Configuration reloaded")
+}
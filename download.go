@@ -1,7 +1,10 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
@@ -16,22 +19,31 @@ import (
 	"github.com/smira/go-ftp-protocol/protocol"
 )
 
-func downloadFromURL(url string, folder string, maxretry int, httpClient *http.Client, fileName string) (path string, newEpisode bool, err error) {
+// Partial download file suffixes, the partial files are kept to resume the download later
+const (
+	PartialSuffix     string = ".part"
+	PartialMetaSuffix string = ".json"
+)
+
+func downloadFromURL(url string, folder string, maxretry int, httpClient *http.Client, fileName string, expected *ExpectedResource) (path string, newEpisode bool, err error) {
 
 	for i := 1; i <= maxretry; i++ {
-		path, newEpisode, err = download(url, folder, httpClient, fileName)
+		path, newEpisode, err = download(url, folder, httpClient, fileName, expected)
 		if err == nil {
 			break
 		} else {
 			logger.Warning.Println("Download failure at attempt "+strconv.Itoa(i)+"/"+strconv.Itoa(maxretry)+" for url "+url, err)
+			if _, rejected := err.(*DownloadValidationError); rejected {
+				break
+			}
 		}
 	}
 	return path, newEpisode, err
 }
 
 func downloadFromURLWithoutName(url string, folder string, maxretry int, httpClient *http.Client) (path string, newEpisode bool, err error) {
-	fileName := extractResourceNameFromURL(url)
-	return downloadFromURL(url, folder, maxretry, httpClient, fileName)
+	fileName := sanitize.Path(extractResourceNameFromURL(url))
+	return downloadFromURL(url, folder, maxretry, httpClient, fileName, nil)
 }
 
 func extractResourceNameFromURL(uri string) string {
@@ -57,63 +69,46 @@ func cleanURL(url string) (cleanURL string) {
 	return cleanURL
 }
 
-func download(referenceURI string, folder string, httpClient *http.Client, fileName string) (path string, newEpisode bool, err error) {
+// download fetches the resource into the folder, the download is validated against the expected resource when given
+//
+// The folder and the file name are expected to be clean, see Podcast.dir and Episode.file.
+func download(referenceURI string, folder string, httpClient *http.Client, fileName string, expected *ExpectedResource) (path string, newEpisode bool, err error) {
 	fileName = filepath.Join(folder, fileName)
-	fileName = sanitize.Path(fileName)
 	uri := cleanURL(referenceURI)
 	logger.Debug.Println("Local resource path : " + fileName)
-	tmpFilename := fileName + ".part"
+	tmpFilename := fileName + PartialSuffix
 	resourceName := filepath.Base(folder) + " - " + filepath.Base(fileName)
-	defer removeTempFile(tmpFilename)
-	var resp *http.Response
 
 	if !pathExists(fileName) {
 		logger.Debug.Println("New resource available : " + resourceName)
-		// TODO: check file existence first with io.IsExist
-		output, err := os.Create(tmpFilename)
-		if err != nil {
-			return fileName, newEpisode, err
-
-		}
-		defer output.Close()
+		var result downloadResult
 
 		if strings.HasPrefix(uri, "ftp") {
 			logger.Debug.Println("FTP download detected")
-			transport := &http.Transport{}
-			transport.RegisterProtocol("ftp", &protocol.FTPRoundTripper{})
-
-			client := &http.Client{Transport: transport}
-			response, err := client.Get(uri)
-			if err != nil {
-				return fileName, newEpisode, err
-
-			}
-			resp = response
+			result, err = downloadFTP(uri, tmpFilename)
 		} else {
+			result, err = downloadHTTP(uri, tmpFilename, httpClient)
+		}
+		if err != nil {
+			return fileName, newEpisode, err
 
-			req, err := http.NewRequest("GET", uri, nil)
-			if err != nil {
-				return fileName, newEpisode, err
-
-			}
-			req.Close = true
-			response, err := httpClient.Do(req)
+		}
+		if expected != nil {
+			err = expected.validate(tmpFilename, result)
 			if err != nil {
+				if _, rejected := err.(*DownloadValidationError); rejected {
+					quarantine(tmpFilename, folder, uri, err)
+				}
 				return fileName, newEpisode, err
-
 			}
-			resp = response
-			defer response.Body.Close()
 		}
+		logger.Debug.Println("Resource downloaded : " + resourceName + " (" + bytefmt.ByteSize(uint64(result.size)) + ")")
 
-		n, err := io.Copy(output, resp.Body)
+		err = os.Rename(tmpFilename, fileName)
 		if err != nil {
 			return fileName, newEpisode, err
-
 		}
-		logger.Debug.Println("Resource downloaded : " + resourceName + " (" + bytefmt.ByteSize(uint64(n)) + ")")
-
-		os.Rename(tmpFilename, fileName)
+		removeTempFile(tmpFilename + PartialMetaSuffix)
 		newEpisode = true
 
 	} else {
@@ -124,6 +119,161 @@ func download(referenceURI string, folder string, httpClient *http.Client, fileN
 	return fileName, newEpisode, err
 }
 
+func downloadFTP(uri string, tmpFilename string) (downloadResult, error) {
+	var result downloadResult
+	output, err := os.Create(tmpFilename)
+	if err != nil {
+		return result, err
+	}
+	defer output.Close()
+
+	transport := &http.Transport{}
+	transport.RegisterProtocol("ftp", &protocol.FTPRoundTripper{})
+	client := &http.Client{Transport: transport}
+	response, err := client.Get(uri)
+	if err != nil {
+		return result, err
+	}
+	defer response.Body.Close()
+	result.size, err = io.Copy(output, response.Body)
+	return result, err
+}
+
+// downloadHTTP downloads the resource into the partial file, a previous partial download is resumed when the server supports it
+func downloadHTTP(uri string, tmpFilename string, httpClient *http.Client) (downloadResult, error) {
+	var result downloadResult
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return result, err
+	}
+	req.Close = true
+
+	var offset int64
+	partial, resumable := readPartialDownload(tmpFilename, uri)
+	if resumable {
+		if info, err := os.Stat(tmpFilename); err == nil && info.Size() > 0 {
+			offset = info.Size()
+			req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+			if partial.ETag != "" && !strings.HasPrefix(partial.ETag, "W/") {
+				req.Header.Set("If-Range", partial.ETag)
+			} else if partial.LastModified != "" {
+				req.Header.Set("If-Range", partial.LastModified)
+			}
+		}
+	}
+
+	response, err := httpClient.Do(req)
+	if err != nil {
+		return result, err
+	}
+	defer response.Body.Close()
+	result.contentType = response.Header.Get("Content-Type")
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	switch {
+	case offset > 0 && response.StatusCode == http.StatusPartialContent:
+		if start, ok := contentRangeStart(response); !ok || start != offset {
+			removePartialDownload(tmpFilename)
+			return result, errors.New("Unexpected content range " + response.Header.Get("Content-Range") + " for " + uri)
+		}
+		result.length = partial.Length
+		logger.Debug.Println("Download resumed at " + bytefmt.ByteSize(uint64(offset)) + " : " + uri)
+		flags = os.O_WRONLY | os.O_APPEND
+	case offset > 0 && response.StatusCode == http.StatusRequestedRangeNotSatisfiable && partial.Length == offset:
+		logger.Debug.Println("Partial download already complete : " + uri)
+		result.size = offset
+		result.length = partial.Length
+		result.contentType = partial.ContentType
+		return result, nil
+	case offset > 0 && response.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// the partial file is not a prefix of the remote resource anymore, the download starts again without range
+		logger.Debug.Println("Range not satisfiable, full download : " + uri)
+		response.Body.Close()
+		removePartialDownload(tmpFilename)
+		return downloadHTTP(uri, tmpFilename, httpClient)
+	case response.StatusCode != http.StatusOK:
+		return result, errors.New("Unexpected http status " + response.Status + " for " + uri)
+	default:
+		if offset > 0 {
+			logger.Debug.Println("Remote resource changed or range not supported, full download : " + uri)
+		}
+		offset = 0
+		partial = PartialDownload{
+			URL:          uri,
+			ETag:         response.Header.Get("ETag"),
+			LastModified: response.Header.Get("Last-Modified"),
+			Length:       response.ContentLength,
+			ContentType:  result.contentType,
+			AcceptRanges: strings.Contains(response.Header.Get("Accept-Ranges"), "bytes"),
+		}
+		if err := writePartialDownload(tmpFilename, partial); err != nil {
+			logger.Warning.Println("Cannot write the partial download state of "+uri, err)
+		}
+		result.length = partial.Length
+	}
+
+	output, err := os.OpenFile(tmpFilename, flags, 0666)
+	if err != nil {
+		return result, err
+	}
+	defer output.Close()
+
+	n, err := io.Copy(output, response.Body)
+	if err == nil && response.ContentLength >= 0 && n < response.ContentLength {
+		err = io.ErrUnexpectedEOF
+	}
+	result.size = offset + n
+	return result, err
+}
+
+// contentRangeStart reads the first byte position of a "Content-Range: bytes start-end/length" header
+func contentRangeStart(response *http.Response) (int64, bool) {
+	contentRange := strings.TrimPrefix(response.Header.Get("Content-Range"), "bytes ")
+	tokens := strings.SplitN(contentRange, "-", 2)
+	if len(tokens) != 2 {
+		return 0, false
+	}
+	start, err := strconv.ParseInt(strings.TrimSpace(tokens[0]), 10, 64)
+	return start, err == nil
+}
+
+// PartialDownload is the state of a partial download, used to resume it safely
+type PartialDownload struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	Length       int64  `json:"length"`
+	ContentType  string `json:"contentType,omitempty"`
+	AcceptRanges bool   `json:"acceptRanges"`
+}
+
+// readPartialDownload tells if the partial file can be resumed with a range request
+func readPartialDownload(tmpFilename string, uri string) (partial PartialDownload, resumable bool) {
+	content, err := ioutil.ReadFile(tmpFilename + PartialMetaSuffix)
+	if err != nil || json.Unmarshal(content, &partial) != nil {
+		return partial, false
+	}
+	return partial, partial.URL == uri && partial.AcceptRanges && (partial.ETag != "" || partial.LastModified != "")
+}
+
+func writePartialDownload(tmpFilename string, partial PartialDownload) error {
+	content, err := json.Marshal(partial)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(tmpFilename+PartialMetaSuffix, content, 0666)
+}
+
+func removePartialDownload(tmpFilename string) {
+	removeTempFile(tmpFilename)
+	removeTempFile(tmpFilename + PartialMetaSuffix)
+}
+
+// isPartialDownload tells if the file is a partial download or its state
+func isPartialDownload(fileName string) bool {
+	return strings.HasSuffix(fileName, PartialSuffix) || strings.HasSuffix(fileName, PartialSuffix+PartialMetaSuffix)
+}
+
 func removeTempFile(tmpFilename string) {
 	if pathExists(tmpFilename) {
 		os.Remove(tmpFilename)
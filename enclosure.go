@@ -0,0 +1,144 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	rss "github.com/jteeuwen/go-pkg-rss"
+	"github.com/spf13/viper"
+)
+
+// PodcastNamespace is the Podcasting 2.0 namespace
+const PodcastNamespace string = "https://podcastindex.org/namespace/1.0"
+
+// Enclosure modes
+const (
+	EnclosureAudio = "audio"
+	EnclosureVideo = "video"
+	EnclosureAny   = "any"
+)
+
+// EnclosurePreference tells which enclosure of an episode is downloaded
+type EnclosurePreference struct {
+	Mode       string
+	MediaTypes []string
+	MaxSize    uint64
+	MaxBitrate int
+}
+
+// enclosureCandidate is an enclosure or an alternate enclosure source of the episode, the bitrate is in kbit/s
+type enclosureCandidate struct {
+	enclosure *rss.Enclosure
+	bitrate   float64
+}
+
+func globalEnclosurePreference() EnclosurePreference {
+	return EnclosurePreference{
+		Mode:       viper.GetString("enclosureMode"),
+		MediaTypes: parseMediaTypes(viper.GetStringSlice("mediaTypes")),
+		MaxSize:    parseByteSize(viper.GetString("maxEnclosureSize")),
+		MaxBitrate: viper.GetInt("maxBitrate"),
+	}
+}
+
+// parseMediaTypes reads the media type preference list, such as "audio/opus > audio/mpeg > video/mp4"
+func parseMediaTypes(values []string) []string {
+	var mediaTypes []string
+	for _, value := range values {
+		for _, mediaType := range strings.FieldsFunc(value, func(r rune) bool { return r == '>' || r == ',' || r == ' ' }) {
+			mediaTypes = append(mediaTypes, strings.ToLower(mediaType))
+		}
+	}
+	return mediaTypes
+}
+
+// accepts tells if the enclosure media type matches the mode
+func (p EnclosurePreference) accepts(mediaType string) bool {
+	mediaType = strings.ToLower(mediaType)
+	switch p.Mode {
+	case EnclosureAny:
+		return true
+	case EnclosureVideo:
+		return strings.Contains(mediaType, "video")
+	}
+	return strings.Contains(mediaType, "audio")
+}
+
+// rank is the position of the media type in the preference list, the unlisted types come last
+func (p EnclosurePreference) rank(mediaType string) int {
+	mediaType = strings.ToLower(strings.TrimSpace(strings.Split(mediaType, ";")[0]))
+	for i, preferred := range p.MediaTypes {
+		if preferred == mediaType || (strings.HasSuffix(preferred, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(preferred, "*"))) {
+			return i
+		}
+	}
+	return len(p.MediaTypes)
+}
+
+// enclosureCandidates lists the enclosures of the item and the sources of its podcast:alternateEnclosure elements
+func enclosureCandidates(item *rss.Item, duration float64) []enclosureCandidate {
+	var candidates []enclosureCandidate
+	for _, enclosure := range item.Enclosures {
+		candidate := enclosureCandidate{enclosure: enclosure}
+		if duration > 0 && enclosure.Length > 0 {
+			candidate.bitrate = float64(enclosure.Length) * 8 / duration / 1000
+		}
+		candidates = append(candidates, candidate)
+	}
+	for _, alternate := range item.Extensions[PodcastNamespace]["alternateEnclosure"] {
+		source := alternateEnclosureSource(alternate)
+		if source == "" {
+			continue
+		}
+		length, _ := strconv.ParseInt(alternate.Attrs["length"], 10, 64)
+		candidate := enclosureCandidate{enclosure: &rss.Enclosure{Url: source, Type: alternate.Attrs["type"], Length: length}}
+		if bitrate, err := strconv.ParseFloat(alternate.Attrs["bitrate"], 64); err == nil {
+			candidate.bitrate = bitrate / 1000
+		} else if duration > 0 && length > 0 {
+			candidate.bitrate = float64(length) * 8 / duration / 1000
+		}
+		candidates = append(candidates, candidate)
+	}
+	return candidates
+}
+
+// alternateEnclosureSource is the http source of the alternate enclosure (torrent and ipfs sources are ignored)
+func alternateEnclosureSource(alternate rss.Extension) string {
+	for _, source := range alternate.Childrens["source"] {
+		uri := strings.TrimSpace(source.Attrs["uri"])
+		if strings.HasPrefix(uri, "http://") || strings.HasPrefix(uri, "https://") {
+			return uri
+		}
+	}
+	return ""
+}
+
+// selectEnclosure picks the preferred media type within the size and bitrate limits, then the largest enclosure
+func (p EnclosurePreference) selectEnclosure(candidates []enclosureCandidate) *rss.Enclosure {
+	var selected *enclosureCandidate
+	for i := range candidates {
+		candidate := &candidates[i]
+		enclosure := candidate.enclosure
+		if !p.accepts(enclosure.Type) {
+			continue
+		}
+		if p.MaxSize > 0 && enclosure.Length > 0 && uint64(enclosure.Length) > p.MaxSize {
+			continue
+		}
+		if p.MaxBitrate > 0 && candidate.bitrate > float64(p.MaxBitrate) {
+			continue
+		}
+		if selected == nil {
+			selected = candidate
+			continue
+		}
+		rank, selectedRank := p.rank(enclosure.Type), p.rank(selected.enclosure.Type)
+		if rank < selectedRank || (rank == selectedRank && enclosure.Length > selected.enclosure.Length) {
+			selected = candidate
+		}
+	}
+	if selected == nil {
+		return nil
+	}
+	return selected.enclosure
+}
@@ -1,11 +1,7 @@
 package main
 
 import (
-	"path/filepath"
-	"strings"
-
 	rss "github.com/jteeuwen/go-pkg-rss"
-	"github.com/kennygrant/sanitize"
 )
 
 //EpisodePrefix is the filename prefix for podcast episode
@@ -16,19 +12,13 @@ type Episode struct {
 	feedEpisode *rss.Item
 	Podcast     *Podcast
 	enclosure   *rss.Enclosure
+	podcasting  PodcastingEpisode
+	path        string
 }
 
 func (e Episode) selectEnclosure() *rss.Enclosure {
-	var selectedEnclosure *rss.Enclosure
-
-	if len(e.feedEpisode.Enclosures) > 0 {
-		for _, enclosure := range e.feedEpisode.Enclosures {
-			if strings.Contains(enclosure.Type, "audio") && (selectedEnclosure == nil || enclosure.Length > selectedEnclosure.Length) {
-				selectedEnclosure = enclosure
-			}
-		}
-	}
-	return selectedEnclosure
+	candidates := enclosureCandidates(e.feedEpisode, e.duration().Seconds())
+	return e.Podcast.settings.Enclosure.selectEnclosure(candidates)
 }
 
 func (e Episode) pubDate() string {
@@ -46,10 +36,12 @@ func (e Episode) formattedPubDate(format string) string {
 	return episodeTimeStr
 }
 
+// file is the episode path, resolved once by NewEpisode with the naming templates
 func (e Episode) file() string {
-
-	fileNamePrefix := EpisodePrefix + e.pubDate() + "-"
-	return filepath.Join(e.Podcast.dir(), sanitize.Path(fileNamePrefix+extractResourceNameFromURL(e.enclosure.Url)))
+	if e.path == "" {
+		return e.legacyFile()
+	}
+	return e.path
 }
 
 func (e Episode) String() string {
@@ -61,6 +53,10 @@ func NewEpisode(feedEpisode *rss.Item, Podcast *Podcast) *Episode {
 	e := new(Episode)
 	e.feedEpisode = feedEpisode
 	e.Podcast = Podcast
+	e.podcasting = NewPodcastingEpisode(feedEpisode)
 	e.enclosure = e.selectEnclosure()
+	if e.enclosure != nil {
+		e.path = e.resolveFile()
+	}
 	return e
 }
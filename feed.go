@@ -4,6 +4,8 @@ package main
 import (
 	"errors"
 	"io"
+	"io/ioutil"
+	"net/http"
 	"strings"
 	"time"
 
@@ -12,14 +14,55 @@ import (
 	xmlx "github.com/jteeuwen/go-pkg-xmlx"
 )
 
-// PollFeed fetches the podcast feed at the given uri
-func PollFeed(uri string, timeout int, cr xmlx.CharsetFunc) {
-	feed := rss.New(timeout, true, chanHandler, itemHandler)
-	if err := feed.Fetch(uri, cr); err != nil {
+// FeedItemHandler handles the feed items, it tells if all of them were processed without failure
+type FeedItemHandler func(feed *rss.Feed, ch *rss.Channel, newitems []*rss.Item) (processed bool)
+
+// PollFeed fetches the podcast feed at the given uri, the items are not handled when the feed has not changed since the last fetch
+//
+// The update hints of the feed are returned to schedule the next poll, handled is false when the items were not handled.
+// With replay, the cached content of an unchanged feed is handled again (the archive and serial feeds progress at each run).
+// The feed content is only cached once all its items were processed, so that the failed downloads are retried at the next run.
+func PollFeed(uri string, client *http.Client, timeout int, cr xmlx.CharsetFunc, handler FeedItemHandler, replay bool) (schedule FeedSchedule, handled bool) {
+	content, entry, modified, err := fetchFeedContent(uri, client)
+	if err != nil {
+		logger.Warning.Println("Feed download failure with "+uri, err)
+		return schedule, false
+	}
+	if !modified {
+		logger.Debug.Println("Feed not modified since the last fetch : " + uri)
+		cached, _ := readFeedCache(uri)
+		if !replay {
+			return cached.Schedule, false
+		}
+		if content, err = ioutil.ReadFile(feedCachePath(uri) + ".xml"); err != nil {
+			logger.Warning.Println("Cannot read the feed cache for "+uri, err)
+			return cached.Schedule, false
+		}
+		entry = cached
+	}
+	processed := true
+	feed := rss.New(timeout, true, chanHandler, func(feed *rss.Feed, ch *rss.Channel, newitems []*rss.Item) {
+		processed = handler(feed, ch, newitems) && processed
+	})
+	if err := feed.FetchBytes(uri, content, cr); err != nil {
 		logger.Warning.Println("Feed parsing failure with "+uri, err)
-		return
+		return schedule, false
+	}
+	if !modified {
+		return entry.Schedule, true
+	}
+	if len(feed.Channels) > 0 {
+		entry.Schedule = NewFeedSchedule(feed.Channels[0])
+		entry.Serial = isSerialChannel(feed.Channels[0])
+	}
+	if !processed {
+		logger.Debug.Println("Feed not cached since some episodes were not processed : " + uri)
+		return entry.Schedule, true
+	}
+	if err := writeFeedCache(entry, content); err != nil {
+		logger.Warning.Println("Cannot write the feed cache for "+uri, err)
 	}
-	//<-time.After(time.Duration(feed.SecondsTillUpdate() * 1e9))
+	return entry.Schedule, true
 }
 
 func charsetReader(charset string, r io.Reader) (io.Reader, error) {
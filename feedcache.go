@@ -0,0 +1,120 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/spf13/viper"
+)
+
+// FeedCacheEntry is the validator of the last fetched feed content
+type FeedCacheEntry struct {
+	URL          string       `json:"url"`
+	ETag         string       `json:"etag,omitempty"`
+	LastModified string       `json:"lastModified,omitempty"`
+	FetchedAt    time.Time    `json:"fetchedAt"`
+	Schedule     FeedSchedule `json:"schedule"`
+	Serial       bool         `json:"serial,omitempty"`
+}
+
+func feedCacheFolder() string {
+	if folder := viper.GetString("feedCache"); folder != "" {
+		return folder
+	}
+	return filepath.Join(targetFolder, ".feeds")
+}
+
+// feedCachePath is the cache file path prefix of the feed, the raw content and the validator are stored side by side
+func feedCachePath(uri string) string {
+	hash := sha1.Sum([]byte(feedKey(uri)))
+	return filepath.Join(feedCacheFolder(), hex.EncodeToString(hash[:]))
+}
+
+func readFeedCache(uri string) (entry FeedCacheEntry, ok bool) {
+	content, err := ioutil.ReadFile(feedCachePath(uri) + ".json")
+	if err != nil || json.Unmarshal(content, &entry) != nil {
+		return entry, false
+	}
+	return entry, pathExists(feedCachePath(uri) + ".xml")
+}
+
+func writeFeedCache(entry FeedCacheEntry, content []byte) error {
+	if err := os.MkdirAll(feedCacheFolder(), 0777); err != nil {
+		return err
+	}
+	validator, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(feedCachePath(entry.URL)+".xml", content); err != nil {
+		return err
+	}
+	return writeFileAtomic(feedCachePath(entry.URL)+".json", validator)
+}
+
+// fetchFeedContent downloads the feed with a conditional request, modified is false when the cached content is still valid
+func fetchFeedContent(uri string, client *http.Client) (content []byte, entry FeedCacheEntry, modified bool, err error) {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return nil, entry, false, err
+	}
+	req.Header.Set("Accept-Encoding", "gzip, br")
+	if cached, ok := readFeedCache(uri); ok {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, entry, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, entry, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, entry, false, errors.New("Unexpected http status " + strconv.Itoa(resp.StatusCode) + " for " + uri)
+	}
+
+	var body io.Reader = resp.Body
+	switch strings.ToLower(resp.Header.Get("Content-Encoding")) {
+	case "gzip":
+		gzipReader, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, entry, false, err
+		}
+		defer gzipReader.Close()
+		body = gzipReader
+	case "br":
+		body = brotli.NewReader(resp.Body)
+	}
+	content, err = ioutil.ReadAll(body)
+	if err != nil {
+		return nil, entry, false, err
+	}
+
+	entry = FeedCacheEntry{
+		URL:          uri,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		FetchedAt:    time.Now(),
+	}
+	return content, entry, true, nil
+}
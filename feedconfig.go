@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// FeedSettings are the settings applied to a feed : the global settings completed with the feed overrides
+type FeedSettings struct {
+	Episodes       int
+	KeptEpisodes   int
+	RetagExisting  bool
+	MaxCommentSize int
+	DateFormat     string
+	KeepAge        time.Duration
+	MaxSize        uint64
+	Filter         *episodeSelector
+	Archive        bool
+	ArchiveLimit   int
+	ArchivePeriod  string
+	Serial         bool
+	SerialWindow   int
+	Enclosure      EnclosurePreference
+	TagTemplates   map[TagField]*template.Template
+	FileTemplate   *template.Template
+	FolderTemplate *template.Template
+}
+
+func (s Subscription) settings() FeedSettings {
+	settings := FeedSettings{
+		Episodes:       maxEpisodes,
+		KeptEpisodes:   keptEpisodes,
+		RetagExisting:  retagExisting,
+		MaxCommentSize: maxCommentSize,
+		DateFormat:     dateFormat,
+		KeepAge:        parseKeepAge(viper.GetString("keepAge")),
+		MaxSize:        parseByteSize(viper.GetString("maxPodcastSize")),
+		ArchiveLimit:   viper.GetInt("archiveLimit"),
+		ArchivePeriod:  viper.GetString("archivePeriod"),
+		SerialWindow:   viper.GetInt("serialWindow"),
+		Enclosure:      globalEnclosurePreference(),
+	}
+	tagTemplates := globalTagTemplates()
+	fileTemplate := viper.GetString("fileTemplate")
+	if s.Episodes != nil {
+		settings.Episodes = *s.Episodes
+	}
+	if s.KeptEpisodes != nil {
+		settings.KeptEpisodes = *s.KeptEpisodes
+	}
+	if s.RetagExisting != nil {
+		settings.RetagExisting = *s.RetagExisting
+	}
+	if s.MaxCommentSize != nil {
+		settings.MaxCommentSize = *s.MaxCommentSize
+	}
+	if s.DateFormat != nil {
+		settings.DateFormat = *s.DateFormat
+	}
+	if s.KeepAge != nil {
+		settings.KeepAge = parseKeepAge(*s.KeepAge)
+	}
+	if s.MaxSize != nil {
+		settings.MaxSize = parseByteSize(*s.MaxSize)
+	}
+	if s.Archive != nil {
+		settings.Archive = *s.Archive
+	}
+	if s.ArchiveLimit != nil {
+		settings.ArchiveLimit = *s.ArchiveLimit
+	}
+	if s.ArchivePeriod != nil {
+		settings.ArchivePeriod = *s.ArchivePeriod
+	}
+	if s.Serial != nil {
+		settings.Serial = *s.Serial
+	} else if cached, ok := readFeedCache(s.URL); ok {
+		settings.Serial = cached.Serial
+	}
+	if s.SerialWindow != nil {
+		settings.SerialWindow = *s.SerialWindow
+	}
+	if s.EnclosureMode != nil {
+		settings.Enclosure.Mode = *s.EnclosureMode
+	}
+	if s.MediaTypes != nil {
+		settings.Enclosure.MediaTypes = parseMediaTypes(s.MediaTypes)
+	}
+	if s.MaxEnclosureSize != nil {
+		settings.Enclosure.MaxSize = parseByteSize(*s.MaxEnclosureSize)
+	}
+	if s.MaxBitrate != nil {
+		settings.Enclosure.MaxBitrate = *s.MaxBitrate
+	}
+	if s.FileTemplate != nil {
+		fileTemplate = *s.FileTemplate
+	}
+	overrideTagTemplates(tagTemplates, s.TagTemplates)
+	settings.TagTemplates = parseTagTemplates(tagTemplates)
+	settings.FileTemplate = parseNamingTemplate("file", fileTemplate)
+	settings.FolderTemplate = parseNamingTemplate("folder", viper.GetString("folderTemplate"))
+	settings.Filter = s.Filter.selector()
+	settings.KeptEpisodes = keptEpisodesCount(settings.KeptEpisodes)
+	return settings
+}
+
+// keptEpisodesCount is the number of episodes to keep, 0 means no old episode removal.
+// It may be lower than the number of downloaded episodes : the state database prevents the removed episodes from being downloaded again.
+func keptEpisodesCount(kept int) int {
+	if kept < 0 {
+		return 0
+	}
+	return kept
+}
+
+// parseKeepAge reads a duration with an optional day unit (30d), empty or invalid values mean no limit
+func parseKeepAge(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" || value == "0" {
+		return 0
+	}
+	if days, err := strconv.Atoi(strings.TrimSuffix(value, "d")); err == nil && strings.HasSuffix(value, "d") {
+		return time.Duration(days) * 24 * time.Hour
+	}
+	age, err := time.ParseDuration(value)
+	if err != nil {
+		logger.Warning.Println("Invalid episode age ignored : " + value)
+		return 0
+	}
+	return age
+}
+
+// parseByteSize reads a size such as 500M or 2G, empty or invalid values mean no limit
+func parseByteSize(value string) uint64 {
+	value = strings.TrimSpace(value)
+	if value == "" || value == "0" {
+		return 0
+	}
+	size, err := bytefmt.ToBytes(value)
+	if err != nil {
+		logger.Warning.Println("Invalid size ignored : " + value)
+		return 0
+	}
+	return size
+}
+
+// client is the http client of the feed, authenticated when the feed has credentials,
+// the default client is used when the settings have not been loaded yet
+func (s Subscription) client() *http.Client {
+	if s.Username == "" && s.Password == "" {
+		if httpClient == nil {
+			return http.DefaultClient
+		}
+		return httpClient
+	}
+	host := ""
+	if parsedURL, err := url.Parse(s.URL); err == nil {
+		host = parsedURL.Host
+	}
+	return &http.Client{Transport: &basicAuthTransport{host: host, username: s.Username, password: s.Password}}
+}
+
+// basicAuthTransport authenticates the requests sent to the feed host only, so that credentials never leak to other hosts
+type basicAuthTransport struct {
+	host     string
+	username string
+	password string
+}
+
+func (t *basicAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host == t.host && req.Header.Get("Authorization") == "" {
+		req = req.Clone(req.Context())
+		req.SetBasicAuth(t.username, t.password)
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// isStructuredFeedsFile tells if the feeds file is a YAML, TOML or JSON file instead of the line based format
+func isStructuredFeedsFile(filePath string) bool {
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".yaml", ".yml", ".toml", ".json":
+		return true
+	}
+	return false
+}
+
+func isYAMLFeedsFile(filePath string) bool {
+	ext := strings.ToLower(filepath.Ext(filePath))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// readStructuredSubscriptions reads the "feeds" list of a structured feeds file
+func readStructuredSubscriptions(filePath string) ([]Subscription, error) {
+	config := viper.New()
+	config.SetConfigFile(filePath)
+	if err := config.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	var subscriptions []Subscription
+	err := config.UnmarshalKey("feeds", &subscriptions, viper.DecodeHook(feedsDecodeHook))
+	return subscriptions, err
+}
+
+// feedsDecodeHook reads the YAML and TOML dates as strings and the comma separated strings as lists
+func feedsDecodeHook(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+	if date, ok := data.(time.Time); ok && to.Kind() == reflect.String {
+		if date.Equal(date.Truncate(24 * time.Hour)) {
+			return date.Format("2006-01-02"), nil
+		}
+		return date.Format(time.RFC3339), nil
+	}
+	if value, ok := data.(string); ok && to.Kind() == reflect.Slice && to.Elem().Kind() == reflect.String {
+		var values []string
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+		return values, nil
+	}
+	return data, nil
+}
+
+// yamlFeedsFile is a YAML feeds file edited as a node tree, so that comments survive an update
+type yamlFeedsFile struct {
+	path     string
+	document yaml.Node
+}
+
+func loadYAMLFeedsFile(filePath string) (*yamlFeedsFile, error) {
+	if !isYAMLFeedsFile(filePath) {
+		return nil, errors.New("Only the YAML structured feeds files can be updated, please edit " + filePath)
+	}
+	f := &yamlFeedsFile{path: filePath}
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err = yaml.Unmarshal(content, &f.document); err != nil {
+		return nil, err
+	}
+	if len(f.document.Content) == 0 {
+		f.document = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	if f.document.Content[0].Kind != yaml.MappingNode {
+		return nil, errors.New("Unexpected feeds file structure : " + filePath)
+	}
+	return f, nil
+}
+
+// feedsNode returns the "feeds" sequence node, it is created if needed
+func (f *yamlFeedsFile) feedsNode() *yaml.Node {
+	root := f.document.Content[0]
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "feeds" {
+			return root.Content[i+1]
+		}
+	}
+	feeds := &yaml.Node{Kind: yaml.SequenceNode}
+	root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: "feeds"}, feeds)
+	return feeds
+}
+
+func (f *yamlFeedsFile) subscriptions() []Subscription {
+	var subscriptions []Subscription
+	for _, node := range f.feedsNode().Content {
+		var subscription Subscription
+		if err := node.Decode(&subscription); err != nil {
+			logger.Warning.Println("Invalid feed entry at line ", node.Line, err)
+			continue
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+	return subscriptions
+}
+
+// find returns the index of the subscription node to the feed url or -1
+func (f *yamlFeedsFile) find(uri string) int {
+	key := feedKey(uri)
+	for i, node := range f.feedsNode().Content {
+		var subscription Subscription
+		if node.Decode(&subscription) == nil && feedKey(subscription.URL) == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func (f *yamlFeedsFile) add(header string, subscriptions []Subscription) {
+	feeds := f.feedsNode()
+	for i, subscription := range subscriptions {
+		node := &yaml.Node{}
+		if err := node.Encode(subscription); err != nil {
+			logger.Warning.Println("Cannot add the feed "+subscription.URL, err)
+			continue
+		}
+		if i == 0 && header != "" {
+			node.HeadComment = header
+		}
+		feeds.Content = append(feeds.Content, node)
+	}
+}
+
+func (f *yamlFeedsFile) remove(uri string) error {
+	i := f.find(uri)
+	if i < 0 {
+		return errors.New("No subscription found for " + uri)
+	}
+	feeds := f.feedsNode()
+	feeds.Content = append(feeds.Content[:i], feeds.Content[i+1:]...)
+	return nil
+}
+
+// setValue updates a subscription field, an empty value removes it
+func (f *yamlFeedsFile) setValue(uri string, key string, value string, tag string) error {
+	i := f.find(uri)
+	if i < 0 {
+		return errors.New("No subscription found for " + uri)
+	}
+	node := f.feedsNode().Content[i]
+	for j := 0; j+1 < len(node.Content); j += 2 {
+		if node.Content[j].Value == key {
+			if value == "" {
+				node.Content = append(node.Content[:j], node.Content[j+2:]...)
+			} else {
+				node.Content[j+1].SetString(value)
+				node.Content[j+1].Tag = tag
+			}
+			return nil
+		}
+	}
+	if value != "" {
+		node.Content = append(node.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Value: key},
+			&yaml.Node{Kind: yaml.ScalarNode, Value: value, Tag: tag})
+	}
+	return nil
+}
+
+func (f *yamlFeedsFile) setTitle(uri string, title string) error {
+	return f.setValue(uri, "title", title, "!!str")
+}
+
+func (f *yamlFeedsFile) setDisabled(uri string, disabled bool) error {
+	if disabled {
+		return f.setValue(uri, "disabled", "true", "!!bool")
+	}
+	return f.setValue(uri, "disabled", "", "")
+}
+
+func (f *yamlFeedsFile) save() error {
+	var content bytes.Buffer
+	encoder := yaml.NewEncoder(&content)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&f.document); err != nil {
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+	return writeFileAtomic(f.path, content.Bytes())
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	rss "github.com/jteeuwen/go-pkg-rss"
+	"github.com/spf13/cobra"
+)
+
+// DisabledFeedPrefix comments out a feeds file line while keeping it known as a subscription
+const DisabledFeedPrefix string = "#disabled "
+
+// Subscription is a feed entry of the feeds file
+//
+// A feeds file line holds the feed url, optionally followed by an annotation
+// with the feed title and its categories :
+//
+//	https://example.com/feed.xml # Title | Category, Other category
+//
+// The structured feeds files (YAML, TOML or JSON) can also override the global settings for each feed.
+type Subscription struct {
+	URL        string   `mapstructure:"url" yaml:"url"`
+	Title      string   `mapstructure:"title" yaml:"title,omitempty"`
+	Categories []string `mapstructure:"categories" yaml:"categories,omitempty"`
+	Disabled   bool     `mapstructure:"disabled" yaml:"disabled,omitempty"`
+	Folder     string   `mapstructure:"folder" yaml:"folder,omitempty"`
+	Username   string   `mapstructure:"username" yaml:"username,omitempty"`
+	Password   string   `mapstructure:"password" yaml:"password,omitempty"`
+
+	Episodes       *int    `mapstructure:"episodes" yaml:"episodes,omitempty"`
+	KeptEpisodes   *int    `mapstructure:"keptEpisodes" yaml:"keptEpisodes,omitempty"`
+	RetagExisting  *bool   `mapstructure:"retagExisting" yaml:"retagExisting,omitempty"`
+	MaxCommentSize *int    `mapstructure:"maxCommentSize" yaml:"maxCommentSize,omitempty"`
+	DateFormat     *string `mapstructure:"dateFormat" yaml:"dateFormat,omitempty"`
+	KeepAge        *string `mapstructure:"keepAge" yaml:"keepAge,omitempty"`
+	MaxSize        *string `mapstructure:"maxSize" yaml:"maxSize,omitempty"`
+	Archive        *bool   `mapstructure:"archive" yaml:"archive,omitempty"`
+	ArchiveLimit   *int    `mapstructure:"archiveLimit" yaml:"archiveLimit,omitempty"`
+	ArchivePeriod  *string `mapstructure:"archivePeriod" yaml:"archivePeriod,omitempty"`
+	Serial         *bool   `mapstructure:"serial" yaml:"serial,omitempty"`
+	SerialWindow   *int    `mapstructure:"serialWindow" yaml:"serialWindow,omitempty"`
+
+	EnclosureMode    *string  `mapstructure:"enclosureMode" yaml:"enclosureMode,omitempty"`
+	MediaTypes       []string `mapstructure:"mediaTypes" yaml:"mediaTypes,omitempty"`
+	MaxEnclosureSize *string  `mapstructure:"maxEnclosureSize" yaml:"maxEnclosureSize,omitempty"`
+	MaxBitrate       *int     `mapstructure:"maxBitrate" yaml:"maxBitrate,omitempty"`
+
+	Filter       *EpisodeFilter    `mapstructure:"filter" yaml:"filter,omitempty"`
+	TagTemplates map[string]string `mapstructure:"tagTemplates" yaml:"tagTemplates,omitempty"`
+	FileTemplate *string           `mapstructure:"fileTemplate" yaml:"fileTemplate,omitempty"`
+}
+
+func (s Subscription) String() string {
+	line := s.URL
+	if s.Title != "" || len(s.Categories) > 0 {
+		line += " # " + cleanAnnotation(s.Title)
+		if len(s.Categories) > 0 {
+			var categories []string
+			for _, category := range s.Categories {
+				categories = append(categories, strings.Replace(cleanAnnotation(category), ",", " ", -1))
+			}
+			line += " | " + strings.Join(categories, ", ")
+		}
+	}
+	return line
+}
+
+func (s Subscription) name() string {
+	if s.Title != "" {
+		return s.Title
+	}
+	return s.URL
+}
+
+func cleanAnnotation(value string) string {
+	value = strings.Replace(value, "|", "/", -1)
+	return strings.Join(strings.Fields(value), " ")
+}
+
+// parseSubscription reads a feeds file line, comments and blank lines are ignored
+func parseSubscription(line string) (subscription Subscription, ok bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return subscription, false
+	}
+	annotation := ""
+	for i := 1; i < len(line); i++ {
+		if line[i] == '#' && (line[i-1] == ' ' || line[i-1] == '\t') {
+			annotation = line[i+1:]
+			line = line[:i]
+			break
+		}
+	}
+	subscription.URL = strings.TrimSpace(line)
+	tokens := strings.SplitN(annotation, "|", 2)
+	subscription.Title = strings.TrimSpace(tokens[0])
+	if len(tokens) > 1 {
+		for _, category := range strings.Split(tokens[1], ",") {
+			category = strings.TrimSpace(category)
+			if category != "" {
+				subscription.Categories = append(subscription.Categories, category)
+			}
+		}
+	}
+	return subscription, true
+}
+
+// parseFeedsLine reads a feeds file line including the disabled subscriptions
+func parseFeedsLine(line string) (subscription Subscription, ok bool) {
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, DisabledFeedPrefix) {
+		subscription, ok = parseSubscription(strings.TrimPrefix(line, DisabledFeedPrefix))
+		subscription.Disabled = true
+		return subscription, ok
+	}
+	return parseSubscription(line)
+}
+
+func formatFeedsLine(subscription Subscription) string {
+	if subscription.Disabled {
+		return DisabledFeedPrefix + subscription.String()
+	}
+	return subscription.String()
+}
+
+// parseSubscriptions reads all the subscriptions of the feeds file, the disabled ones included
+func parseSubscriptions(filePath string) ([]Subscription, error) {
+	if isStructuredFeedsFile(filePath) {
+		return readStructuredSubscriptions(filePath)
+	}
+	var subscriptions []Subscription
+	content, err := ioutil.ReadFile(filePath)
+	if err == nil {
+		for _, line := range strings.Split(string(content), "\n") {
+			if subscription, ok := parseFeedsLine(line); ok {
+				subscriptions = append(subscriptions, subscription)
+			}
+		}
+	}
+	return subscriptions, err
+}
+
+// feedKey is the feed url used to detect duplicate subscriptions
+func feedKey(uri string) string {
+	uri = strings.TrimSuffix(strings.TrimSpace(uri), "/")
+	parsedURL, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	parsedURL.Scheme = strings.ToLower(parsedURL.Scheme)
+	parsedURL.Host = strings.ToLower(parsedURL.Host)
+	return parsedURL.String()
+}
+
+// feedsStore edits the subscriptions of a feeds file
+type feedsStore interface {
+	subscriptions() []Subscription
+	add(header string, subscriptions []Subscription)
+	remove(uri string) error
+	setTitle(uri string, title string) error
+	setDisabled(uri string, disabled bool) error
+	save() error
+}
+
+func loadFeedsStore(filePath string) (feedsStore, error) {
+	if isStructuredFeedsFile(filePath) {
+		return loadYAMLFeedsFile(filePath)
+	}
+	return loadFeedsFile(filePath)
+}
+
+func findSubscription(store feedsStore, uri string) (Subscription, bool) {
+	key := feedKey(uri)
+	for _, subscription := range store.subscriptions() {
+		if feedKey(subscription.URL) == key {
+			return subscription, true
+		}
+	}
+	return Subscription{}, false
+}
+
+// feedsFile is the feeds file content kept line by line, so that comments survive an update
+type feedsFile struct {
+	path  string
+	lines []string
+}
+
+func loadFeedsFile(filePath string) (*feedsFile, error) {
+	f := &feedsFile{path: filePath}
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return f, nil
+		}
+		return nil, err
+	}
+	f.lines = strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	return f, nil
+}
+
+func (f *feedsFile) subscriptions() []Subscription {
+	var subscriptions []Subscription
+	for _, line := range f.lines {
+		if subscription, ok := parseFeedsLine(line); ok {
+			subscriptions = append(subscriptions, subscription)
+		}
+	}
+	return subscriptions
+}
+
+// find returns the line index of the subscription to the feed url or -1
+func (f *feedsFile) find(uri string) int {
+	key := feedKey(uri)
+	for i, line := range f.lines {
+		if subscription, ok := parseFeedsLine(line); ok && feedKey(subscription.URL) == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func (f *feedsFile) add(header string, subscriptions []Subscription) {
+	if header != "" {
+		f.lines = append(f.lines, "# "+header)
+	}
+	for _, subscription := range subscriptions {
+		f.lines = append(f.lines, formatFeedsLine(subscription))
+	}
+}
+
+func (f *feedsFile) update(uri string, change func(subscription *Subscription)) error {
+	i := f.find(uri)
+	if i < 0 {
+		return errors.New("No subscription found for " + uri)
+	}
+	subscription, _ := parseFeedsLine(f.lines[i])
+	change(&subscription)
+	f.lines[i] = formatFeedsLine(subscription)
+	return nil
+}
+
+func (f *feedsFile) setTitle(uri string, title string) error {
+	return f.update(uri, func(subscription *Subscription) { subscription.Title = title })
+}
+
+func (f *feedsFile) setDisabled(uri string, disabled bool) error {
+	return f.update(uri, func(subscription *Subscription) { subscription.Disabled = disabled })
+}
+
+func (f *feedsFile) remove(uri string) error {
+	i := f.find(uri)
+	if i < 0 {
+		return errors.New("No subscription found for " + uri)
+	}
+	f.lines = append(f.lines[:i], f.lines[i+1:]...)
+	return nil
+}
+
+func (f *feedsFile) save() error {
+	content := strings.Join(f.lines, "\n")
+	if content != "" {
+		content += "\n"
+	}
+	return writeFileAtomic(f.path, []byte(content))
+}
+
+// probeFeed fetches and parses the feed to make sure it is a valid podcast feed
+func probeFeed(subscription *Subscription) (*rss.Channel, error) {
+	feed := rss.New(5, true, func(*rss.Feed, []*rss.Channel) {}, func(*rss.Feed, *rss.Channel, []*rss.Item) {})
+	if err := feed.FetchClient(subscription.URL, subscription.client(), charsetReader); err != nil {
+		return nil, err
+	}
+	if len(feed.Channels) == 0 {
+		return nil, errors.New("No channel found in the feed " + subscription.URL)
+	}
+	channel := feed.Channels[0]
+	completeChannelTitle(feed, channel)
+	return channel, nil
+}
+
+func newFeedsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "feeds",
+		Short: "Manage the subscriptions of the feeds file",
+	}
+
+	var title string
+	var categories []string
+	var noCheck bool
+	addCmd := &cobra.Command{
+		Use:   "add <url>",
+		Short: "Subscribe to a feed once checked that it can be parsed",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			exitOnError("Cannot add the feed", addFeed(args[0], title, categories, !noCheck))
+		},
+	}
+	addCmd.Flags().StringVarP(&title, "title", "t", "", "Feed title (podcast title by default)")
+	addCmd.Flags().StringSliceVarP(&categories, "category", "c", nil, "Feed categories")
+	addCmd.Flags().BoolVar(&noCheck, "no-check", false, "Do not fetch the feed before adding it")
+
+	var offline bool
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the subscriptions with their podcast title and folder",
+		Long:  `List the subscriptions as tab separated lines : status, podcast title, podcast folder and feed url`,
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			exitOnError("Cannot list the feeds", listFeeds(offline))
+		},
+	}
+	listCmd.Flags().BoolVar(&offline, "offline", false, "Do not fetch the feeds, use the feeds file titles")
+
+	cmd.AddCommand(
+		addCmd,
+		listCmd,
+		&cobra.Command{
+			Use:   "remove <url>",
+			Short: "Unsubscribe from a feed",
+			Args:  cobra.ExactArgs(1),
+			Run: func(cmd *cobra.Command, args []string) {
+				exitOnError("Cannot remove the feed", editFeeds(func(store feedsStore) error { return store.remove(args[0]) }))
+				logger.Info.Println("Feed removed : " + args[0])
+			},
+		},
+		&cobra.Command{
+			Use:   "rename <url> <title>",
+			Short: "Change the title of a subscription",
+			Args:  cobra.ExactArgs(2),
+			Run: func(cmd *cobra.Command, args []string) {
+				exitOnError("Cannot rename the feed", editFeeds(func(store feedsStore) error { return store.setTitle(args[0], args[1]) }))
+				logger.Info.Println("Feed renamed : " + args[0] + " -> " + args[1])
+			},
+		},
+		&cobra.Command{
+			Use:   "disable <url>",
+			Short: "Stop fetching a feed without removing it",
+			Args:  cobra.ExactArgs(1),
+			Run: func(cmd *cobra.Command, args []string) {
+				exitOnError("Cannot disable the feed", editFeeds(func(store feedsStore) error { return store.setDisabled(args[0], true) }))
+				logger.Info.Println("Feed disabled : " + args[0])
+			},
+		},
+		&cobra.Command{
+			Use:   "enable <url>",
+			Short: "Fetch a disabled feed again",
+			Args:  cobra.ExactArgs(1),
+			Run: func(cmd *cobra.Command, args []string) {
+				exitOnError("Cannot enable the feed", editFeeds(func(store feedsStore) error { return store.setDisabled(args[0], false) }))
+				logger.Info.Println("Feed enabled : " + args[0])
+			},
+		},
+	)
+	return cmd
+}
+
+func editFeeds(edit func(store feedsStore) error) error {
+	store, err := loadFeedsStore(feedsPath)
+	if err == nil {
+		err = edit(store)
+	}
+	if err == nil {
+		err = store.save()
+	}
+	return err
+}
+
+func addFeed(uri string, title string, categories []string, check bool) error {
+	uri = strings.TrimSpace(uri)
+	store, err := loadFeedsStore(feedsPath)
+	if err != nil {
+		return err
+	}
+	if _, found := findSubscription(store, uri); found {
+		return errors.New("Feed already subscribed : " + uri)
+	}
+	subscription := Subscription{URL: uri, Title: title, Categories: categories}
+	if check {
+		channel, err := probeFeed(&subscription)
+		if err != nil {
+			return err
+		}
+		if subscription.Title == "" {
+			subscription.Title = channel.Title
+		}
+		if len(subscription.Categories) == 0 {
+			subscription.Categories = NewPodcast(targetFolder, channel, &subscription).categories()
+		}
+	}
+	store.add("", []Subscription{subscription})
+	if err = store.save(); err == nil {
+		logger.Info.Println("Feed added : " + subscription.name() + " (" + uri + ")")
+	}
+	return err
+}
+
+func listFeeds(offline bool) error {
+	subscriptions, err := parseSubscriptions(feedsPath)
+	if err != nil {
+		return err
+	}
+
+	type feedListing struct {
+		subscription Subscription
+		title        string
+		folder       string
+	}
+	var listings []*feedListing
+	for _, subscription := range subscriptions {
+		listings = append(listings, &feedListing{subscription: subscription})
+	}
+
+	var wg sync.WaitGroup
+	runners := make(chan bool, maxFeedRunner)
+	for _, listing := range listings {
+		if offline {
+			listing.title = listing.subscription.Title
+			continue
+		}
+		wg.Add(1)
+		go func(listing *feedListing) {
+			defer wg.Done()
+			runners <- true
+			defer func() { <-runners }()
+			channel, err := probeFeed(&listing.subscription)
+			if err != nil {
+				logger.Warning.Println("Feed parsing failure with "+listing.subscription.URL, err)
+				return
+			}
+			listing.title = channel.Title
+			listing.folder = NewPodcast(targetFolder, channel, &listing.subscription).dir()
+		}(listing)
+	}
+	wg.Wait()
+
+	for _, listing := range listings {
+		status := "enabled"
+		if listing.subscription.Disabled {
+			status = "disabled"
+		}
+		logger.Info.Println(strings.Join([]string{status, listing.title, listing.folder, listing.subscription.URL}, "\t"))
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// EpisodeFilter are the episode selection rules of a feed, an empty rule selects every episode
+type EpisodeFilter struct {
+	Include            string   `mapstructure:"include" yaml:"include,omitempty"`
+	Exclude            string   `mapstructure:"exclude" yaml:"exclude,omitempty"`
+	IncludeDescription string   `mapstructure:"includeDescription" yaml:"includeDescription,omitempty"`
+	ExcludeDescription string   `mapstructure:"excludeDescription" yaml:"excludeDescription,omitempty"`
+	PublishedAfter     string   `mapstructure:"publishedAfter" yaml:"publishedAfter,omitempty"`
+	PublishedBefore    string   `mapstructure:"publishedBefore" yaml:"publishedBefore,omitempty"`
+	MinDuration        string   `mapstructure:"minDuration" yaml:"minDuration,omitempty"`
+	MaxDuration        string   `mapstructure:"maxDuration" yaml:"maxDuration,omitempty"`
+	SkipEpisodeTypes   []string `mapstructure:"skipEpisodeTypes" yaml:"skipEpisodeTypes,omitempty"`
+	SkipExplicit       bool     `mapstructure:"skipExplicit" yaml:"skipExplicit,omitempty"`
+	SkipBlocked        bool     `mapstructure:"skipBlocked" yaml:"skipBlocked,omitempty"`
+}
+
+// episodeSelector is the parsed episode filter, the invalid rules are ignored
+type episodeSelector struct {
+	include            *regexp.Regexp
+	exclude            *regexp.Regexp
+	includeDescription *regexp.Regexp
+	excludeDescription *regexp.Regexp
+	publishedAfter     time.Time
+	publishedBefore    time.Time
+	minDuration        time.Duration
+	maxDuration        time.Duration
+	skipEpisodeTypes   []string
+	skipExplicit       bool
+	skipBlocked        bool
+}
+
+func (f *EpisodeFilter) selector() *episodeSelector {
+	if f == nil {
+		return nil
+	}
+	selector := &episodeSelector{
+		include:            filterRegexp(f.Include),
+		exclude:            filterRegexp(f.Exclude),
+		includeDescription: filterRegexp(f.IncludeDescription),
+		excludeDescription: filterRegexp(f.ExcludeDescription),
+		publishedAfter:     filterDate(f.PublishedAfter),
+		publishedBefore:    filterDate(f.PublishedBefore),
+		minDuration:        filterDuration(f.MinDuration),
+		maxDuration:        filterDuration(f.MaxDuration),
+		skipExplicit:       f.SkipExplicit,
+		skipBlocked:        f.SkipBlocked,
+	}
+	for _, episodeType := range f.SkipEpisodeTypes {
+		selector.skipEpisodeTypes = append(selector.skipEpisodeTypes, strings.ToLower(strings.TrimSpace(episodeType)))
+	}
+	return selector
+}
+
+func filterRegexp(expression string) *regexp.Regexp {
+	if expression == "" {
+		return nil
+	}
+	compiled, err := regexp.Compile(expression)
+	if err != nil {
+		logger.Warning.Println("Invalid episode filter expression ignored : "+expression, err)
+		return nil
+	}
+	return compiled
+}
+
+func filterDate(value string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+	for _, layout := range []string{"2006-01-02", time.RFC3339} {
+		if date, err := time.Parse(layout, value); err == nil {
+			return date
+		}
+	}
+	logger.Warning.Println("Invalid episode filter date ignored : " + value)
+	return time.Time{}
+}
+
+func filterDuration(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		logger.Warning.Println("Invalid episode filter duration ignored : " + value)
+		return 0
+	}
+	return duration
+}
+
+// skipReason tells why the episode is not selected, an empty reason means that the episode is selected
+func (s *episodeSelector) skipReason(episode *Episode) string {
+	if s == nil {
+		return ""
+	}
+	item := episode.feedEpisode
+	if s.include != nil && !s.include.MatchString(item.Title) {
+		return "title not matching " + s.include.String()
+	}
+	if s.exclude != nil && s.exclude.MatchString(item.Title) {
+		return "title matching " + s.exclude.String()
+	}
+	if s.includeDescription != nil && !s.includeDescription.MatchString(item.Description) {
+		return "description not matching " + s.includeDescription.String()
+	}
+	if s.excludeDescription != nil && s.excludeDescription.MatchString(item.Description) {
+		return "description matching " + s.excludeDescription.String()
+	}
+	if !s.publishedAfter.IsZero() || !s.publishedBefore.IsZero() {
+		published, err := item.ParsedPubDate()
+		switch {
+		case err != nil:
+			return "unknown publication date " + item.PubDate
+		case !s.publishedAfter.IsZero() && published.Before(s.publishedAfter):
+			return "published before " + s.publishedAfter.Format("2006-01-02")
+		case !s.publishedBefore.IsZero() && !published.Before(s.publishedBefore):
+			return "published after " + s.publishedBefore.Format("2006-01-02")
+		}
+	}
+	if duration := episode.duration(); duration > 0 {
+		if s.minDuration > 0 && duration < s.minDuration {
+			return "duration " + duration.String() + " shorter than " + s.minDuration.String()
+		}
+		if s.maxDuration > 0 && duration > s.maxDuration {
+			return "duration " + duration.String() + " longer than " + s.maxDuration.String()
+		}
+	}
+	if episodeType := episode.episodeType(); containsString(s.skipEpisodeTypes, episodeType) {
+		return episodeType + " episode"
+	}
+	if s.skipExplicit && episode.explicit() {
+		return "explicit episode"
+	}
+	if s.skipBlocked && episode.blocked() {
+		return "blocked episode"
+	}
+	if s.skipBlocked && episode.Podcast.blocked() {
+		return "blocked podcast"
+	}
+	return ""
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// FLAC metadata block types
+const (
+	flacStreamInfo    byte = 0
+	flacPadding       byte = 1
+	flacVorbisComment byte = 4
+	flacPictureBlock  byte = 6
+)
+
+// flacBlock is a FLAC metadata block, the data of the Vorbis comment block is encoded on save
+type flacBlock struct {
+	kind byte
+	data []byte
+}
+
+// flacFile is a FLAC file with its Vorbis comments
+type flacFile struct {
+	path        string
+	blocks      []flacBlock
+	vendor      string
+	comments    []string
+	sampleRate  int
+	samples     int64
+	audioOffset int64
+}
+
+func openFLACFile(path string) (*flacFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(file, header); err != nil || string(header) != "fLaC" {
+		return nil, errors.New("Invalid FLAC file : " + path)
+	}
+	f := &flacFile{path: path, audioOffset: 4}
+	commented := false
+	for last := false; !last; {
+		if _, err = io.ReadFull(file, header); err != nil {
+			return nil, err
+		}
+		last = header[0]&0x80 != 0
+		block := flacBlock{kind: header[0] & 0x7f, data: make([]byte, int(header[1])<<16|int(header[2])<<8|int(header[3]))}
+		if _, err = io.ReadFull(file, block.data); err != nil {
+			return nil, err
+		}
+		f.audioOffset += int64(4 + len(block.data))
+		switch block.kind {
+		case flacStreamInfo:
+			if len(block.data) < 18 {
+				return nil, errors.New("Invalid FLAC stream info : " + path)
+			}
+			data := block.data
+			f.sampleRate = int(data[10])<<12 | int(data[11])<<4 | int(data[12])>>4
+			f.samples = int64(data[13]&0x0f)<<32 | int64(binary.BigEndian.Uint32(data[14:]))
+		case flacVorbisComment:
+			var ok bool
+			if f.vendor, f.comments, _, ok = parseVorbisComments(block.data); !ok {
+				return nil, errors.New("Invalid Vorbis comments : " + path)
+			}
+			block.data, commented = nil, true
+		case flacPadding:
+			continue
+		case 127:
+			return nil, errors.New("Invalid FLAC metadata block : " + path)
+		}
+		f.blocks = append(f.blocks, block)
+	}
+	if len(f.blocks) == 0 || f.blocks[0].kind != flacStreamInfo {
+		return nil, errors.New("No FLAC stream info : " + path)
+	}
+	if !commented {
+		f.vendor = "blackpodder"
+		f.blocks = append(f.blocks, flacBlock{kind: flacVorbisComment})
+	}
+	return f, nil
+}
+
+func (f *flacFile) setTag(field TagField, value string) {
+	if name, found := vorbisCommentFields[field]; found {
+		f.comments = setVorbisComment(f.comments, name, value)
+	}
+}
+
+// setPicture replaces the front cover picture block, the other pictures are kept
+func (f *flacFile) setPicture(artwork *Artwork) {
+	var blocks []flacBlock
+	for _, block := range f.blocks {
+		if block.kind != flacPictureBlock || len(block.data) < 4 || binary.BigEndian.Uint32(block.data) != 3 {
+			blocks = append(blocks, block)
+		}
+	}
+	f.blocks = append(blocks, flacBlock{kind: flacPictureBlock, data: flacPicture(artwork)})
+}
+
+// length is the duration given by the total samples of the stream info
+func (f *flacFile) length() time.Duration {
+	if f.sampleRate == 0 {
+		return 0
+	}
+	return time.Duration(f.samples * int64(time.Second) / int64(f.sampleRate))
+}
+
+// save rewrites the metadata blocks followed by a padding block, the audio frames are copied unchanged
+func (f *flacFile) save() error {
+	metadata := []byte("fLaC")
+	blocks := append(append([]flacBlock{}, f.blocks...), flacBlock{kind: flacPadding, data: make([]byte, ID3Padding)})
+	for i, block := range blocks {
+		if block.kind == flacVorbisComment {
+			block.data = encodeVorbisComments(f.vendor, f.comments)
+		}
+		if len(block.data) >= 1<<24 {
+			return errors.New("FLAC metadata block too large : " + f.path)
+		}
+		header := []byte{block.kind, byte(len(block.data) >> 16), byte(len(block.data) >> 8), byte(len(block.data))}
+		if i == len(blocks)-1 {
+			header[0] |= 0x80
+		}
+		metadata = append(append(metadata, header...), block.data...)
+	}
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err = file.Seek(f.audioOffset, io.SeekStart); err != nil {
+		return err
+	}
+	err = writeFileAtomicWith(f.path, func(w io.Writer) error {
+		if _, err := w.Write(metadata); err != nil {
+			return err
+		}
+		_, err := io.Copy(w, file)
+		return err
+	})
+	if err == nil {
+		f.audioOffset = int64(len(metadata))
+	}
+	return err
+}
+
+// flacPicture encodes the artwork as a FLAC front cover picture block
+func flacPicture(artwork *Artwork) []byte {
+	block := make([]byte, 0, 32+len(artwork.MediaType)+len(artwork.Content))
+	number := make([]byte, 4)
+	appendNumber := func(value int) {
+		binary.BigEndian.PutUint32(number, uint32(value))
+		block = append(block, number...)
+	}
+	appendNumber(3)
+	appendNumber(len(artwork.MediaType))
+	block = append(block, artwork.MediaType...)
+	appendNumber(0)
+	appendNumber(artwork.Width)
+	appendNumber(artwork.Height)
+	appendNumber(24)
+	appendNumber(0)
+	appendNumber(len(artwork.Content))
+	return append(block, artwork.Content...)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// flacFixture encodes a FLAC file with a stream info of 3 seconds at 44.1kHz, a Vorbis comment, a padding and an application block
+func flacFixture(audio []byte) []byte {
+	streamInfo := make([]byte, 34)
+	sampleRate := 44100
+	streamInfo[10], streamInfo[11], streamInfo[12] = byte(sampleRate>>12), byte(sampleRate>>4), byte(sampleRate<<4)
+	binary.BigEndian.PutUint32(streamInfo[14:], uint32(3*sampleRate))
+	block := func(kind byte, data []byte) []byte {
+		return append([]byte{kind, byte(len(data) >> 16), byte(len(data) >> 8), byte(len(data))}, data...)
+	}
+	content := append([]byte("fLaC"), block(flacStreamInfo, streamInfo)...)
+	content = append(content, block(flacVorbisComment, encodeVorbisComments("fixture", []string{"TITLE=Old title", "ARTIST=Someone"}))...)
+	content = append(content, block(flacPadding, make([]byte, 100))...)
+	content = append(content, block(0x80|2, []byte("appldata"))...)
+	return append(content, audio...)
+}
+
+func TestFLACRoundTrip(t *testing.T) {
+	logger = NewLogger(false)
+	audio := []byte{0xff, 0xf8, 1, 2, 3, 4}
+	path := writeFixture(t, "episode.flac", flacFixture(audio))
+	defer os.RemoveAll(filepath.Dir(path))
+
+	tag, err := openTagFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag.length().Seconds() != 3 {
+		t.Fatalf("Unexpected FLAC length %v", tag.length())
+	}
+	description := strings.Repeat("d", 5000)
+	tag.setTag(TagTitle, "New title")
+	tag.setTag(TagDescription, description)
+	tag.setPicture(&Artwork{MediaType: "image/jpeg", Width: 1, Height: 1, Content: []byte("jpeg")})
+	if err = tag.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(content, audio) {
+		t.Fatal("FLAC audio frames changed")
+	}
+	f, err := openFLACFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.audioOffset != int64(len(content)-len(audio)) || f.length() != tag.length() {
+		t.Fatalf("FLAC metadata blocks badly written")
+	}
+	expected := []string{"TITLE=New title", "ARTIST=Someone", "DESCRIPTION=" + description}
+	if strings.Join(f.comments, "\n") != strings.Join(expected, "\n") || f.vendor != "fixture" {
+		t.Fatalf("Unexpected Vorbis comments %v", f.comments)
+	}
+	var kinds []byte
+	for _, block := range f.blocks {
+		kinds = append(kinds, block.kind)
+	}
+	if !bytes.Equal(kinds, []byte{flacStreamInfo, flacVorbisComment, 2, flacPictureBlock}) {
+		t.Fatalf("Unexpected FLAC metadata blocks %v", kinds)
+	}
+	if !bytes.Equal(f.blocks[3].data, flacPicture(&Artwork{MediaType: "image/jpeg", Width: 1, Height: 1, Content: []byte("jpeg")})) {
+		t.Fatal("FLAC picture badly written")
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"time"
+	"unicode/utf16"
+)
+
+// ID3Padding is the free space left at the end of a rewritten ID3v2 tag
+const ID3Padding int = 1024
+
+// id3Frame is a raw ID3v2 frame, the frame data is kept as read
+type id3Frame struct {
+	ID    string
+	Flags uint16
+	Data  []byte
+}
+
+// id3Tag is the ID3v2 tag at the beginning of a mp3 file, only the versions 2.3 and 2.4 are supported
+type id3Tag struct {
+	version byte
+	frames  []id3Frame
+}
+
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+func putSyncsafe(b []byte, value int) {
+	b[0] = byte(value>>21) & 0x7f
+	b[1] = byte(value>>14) & 0x7f
+	b[2] = byte(value>>7) & 0x7f
+	b[3] = byte(value) & 0x7f
+}
+
+// readID3Tag reads the ID3v2 tag of the file and returns the offset of the audio data.
+// A file without tag gets an empty version 2.4 tag.
+func readID3Tag(r io.Reader) (tag *id3Tag, audioOffset int64, err error) {
+	header := make([]byte, 10)
+	if _, err = io.ReadFull(r, header); err != nil || string(header[:3]) != "ID3" {
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			err = nil
+		}
+		return &id3Tag{version: 4}, 0, err
+	}
+	tag = &id3Tag{version: header[3]}
+	if tag.version != 3 && tag.version != 4 {
+		return nil, 0, errors.New("Unsupported ID3v2." + strconv.Itoa(int(tag.version)) + " tag")
+	}
+	flags := header[5]
+	if flags&0x80 != 0 {
+		return nil, 0, errors.New("Unsupported unsynchronised ID3v2 tag")
+	}
+	size := syncsafe(header[6:])
+	audioOffset = int64(10 + size)
+	if flags&0x10 != 0 {
+		audioOffset += 10
+	}
+	content := make([]byte, size)
+	if _, err = io.ReadFull(r, content); err != nil {
+		return nil, 0, err
+	}
+	if flags&0x40 != 0 && len(content) >= 4 {
+		extendedSize := int(binary.BigEndian.Uint32(content)) + 4
+		if tag.version == 4 {
+			extendedSize = syncsafe(content)
+		}
+		if extendedSize > len(content) {
+			return nil, 0, errors.New("Invalid ID3v2 extended header")
+		}
+		content = content[extendedSize:]
+	}
+	for len(content) >= 10 && content[0] != 0 {
+		frameSize := int(binary.BigEndian.Uint32(content[4:]))
+		if tag.version == 4 {
+			frameSize = syncsafe(content[4:])
+		}
+		if 10+frameSize > len(content) {
+			return nil, 0, errors.New("Invalid ID3v2 frame size : " + string(content[:4]))
+		}
+		tag.frames = append(tag.frames, id3Frame{
+			ID:    string(content[:4]),
+			Flags: binary.BigEndian.Uint16(content[8:]),
+			Data:  content[10 : 10+frameSize],
+		})
+		content = content[10+frameSize:]
+	}
+	return tag, audioOffset, nil
+}
+
+// removeFrames removes all the frames with one of the ids
+func (tag *id3Tag) removeFrames(ids ...string) {
+	var frames []id3Frame
+	for _, frame := range tag.frames {
+		if !containsString(ids, frame.ID) {
+			frames = append(frames, frame)
+		}
+	}
+	tag.frames = frames
+}
+
+func (tag *id3Tag) addFrame(id string, data []byte) {
+	tag.frames = append(tag.frames, id3Frame{ID: id, Data: data})
+}
+
+// encodeFrames serializes the frames, without tag header, as the content of a tag or of a chapter frame
+func (tag *id3Tag) encodeFrames(frames []id3Frame) []byte {
+	var buffer bytes.Buffer
+	header := make([]byte, 10)
+	for _, frame := range frames {
+		copy(header, frame.ID)
+		if tag.version == 4 {
+			putSyncsafe(header[4:], len(frame.Data))
+		} else {
+			binary.BigEndian.PutUint32(header[4:], uint32(len(frame.Data)))
+		}
+		binary.BigEndian.PutUint16(header[8:], frame.Flags)
+		buffer.Write(header)
+		buffer.Write(frame.Data)
+	}
+	return buffer.Bytes()
+}
+
+func (tag *id3Tag) encode() []byte {
+	content := tag.encodeFrames(tag.frames)
+	header := []byte{'I', 'D', '3', tag.version, 0, 0, 0, 0, 0, 0}
+	putSyncsafe(header[6:], len(content)+ID3Padding)
+	return append(append(header, content...), make([]byte, ID3Padding)...)
+}
+
+// encodeText encodes a string with its encoding byte, UTF-8 for ID3v2.4 and UTF-16 for ID3v2.3
+func (tag *id3Tag) encodeText(text string) []byte {
+	return append([]byte{tag.textEncoding()}, tag.encodeString(text, false)...)
+}
+
+func (tag *id3Tag) textEncoding() byte {
+	if tag.version == 4 {
+		return 3
+	}
+	return 1
+}
+
+// encodeString encodes a string with the tag text encoding, optionally followed by the string terminator
+func (tag *id3Tag) encodeString(text string, terminated bool) []byte {
+	if tag.version == 4 {
+		if terminated {
+			return append([]byte(text), 0)
+		}
+		return []byte(text)
+	}
+	encoded := []byte{0xff, 0xfe}
+	for _, unit := range utf16.Encode([]rune(text)) {
+		encoded = append(encoded, byte(unit), byte(unit>>8))
+	}
+	if terminated {
+		encoded = append(encoded, 0, 0)
+	}
+	return encoded
+}
+
+// encodePicture encodes an APIC frame of the given picture type with an empty description
+func (tag *id3Tag) encodePicture(mediaType string, pictureType byte, content []byte) []byte {
+	data := append([]byte{tag.textEncoding()}, mediaType...)
+	data = append(data, 0, pictureType)
+	data = append(data, tag.encodeString("", true)...)
+	return append(data, content...)
+}
+
+// setFrame replaces the first frame with the id, the other frames with the same id are removed
+func (tag *id3Tag) setFrame(id string, data []byte) {
+	var frames []id3Frame
+	replaced := false
+	for _, frame := range tag.frames {
+		if frame.ID != id {
+			frames = append(frames, frame)
+		} else if !replaced {
+			frames = append(frames, id3Frame{ID: id, Data: data})
+			replaced = true
+		}
+	}
+	if !replaced {
+		frames = append(frames, id3Frame{ID: id, Data: data})
+	}
+	tag.frames = frames
+}
+
+// hasEmptyDescription tells if the COMM, USLT or TXXX like frame data has an empty content descriptor
+func hasEmptyDescription(data []byte, descriptionOffset int) bool {
+	if len(data) <= descriptionOffset {
+		return true
+	}
+	description := data[descriptionOffset:]
+	if data[0] == 1 || data[0] == 2 {
+		if len(description) >= 2 && (description[0] == 0xff && description[1] == 0xfe || description[0] == 0xfe && description[1] == 0xff) {
+			description = description[2:]
+		}
+		return len(description) < 2 || description[0] == 0 && description[1] == 0
+	}
+	return description[0] == 0
+}
+
+// id3TextFrames are the text frames of the episode tags, the iTunes podcast frames (WFED, TGID, TDES, TCAT, TKWD, TDRL)
+// are text frames too, even in ID3v2.3
+var id3TextFrames = map[TagField]string{
+	TagTitle:       "TIT2",
+	TagArtist:      "TPE1",
+	TagAlbum:       "TALB",
+	TagGenre:       "TCON",
+	TagTrack:       "TRCK",
+	TagAlbumArtist: "TPE2",
+	TagDisc:        "TPOS",
+	TagFeedURL:     "WFED",
+	TagEpisodeID:   "TGID",
+	TagDescription: "TDES",
+	TagCategory:    "TCAT",
+	TagKeywords:    "TKWD",
+	TagReleaseDate: "TDRL",
+}
+
+// id3File is a mp3 or aac file with its ID3v2 tag
+type id3File struct {
+	path        string
+	tag         *id3Tag
+	audioOffset int64
+}
+
+func openID3File(path string) (*id3File, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	tag, audioOffset, err := readID3Tag(file)
+	if err != nil {
+		return nil, err
+	}
+	return &id3File{path: path, tag: tag, audioOffset: audioOffset}, nil
+}
+
+func (f *id3File) setTag(field TagField, value string) {
+	switch field {
+	case TagComment:
+		var frames []id3Frame
+		for _, frame := range f.tag.frames {
+			if frame.ID != "COMM" || !hasEmptyDescription(frame.Data, 4) {
+				frames = append(frames, frame)
+			}
+		}
+		f.tag.frames = frames
+		data := append([]byte{f.tag.textEncoding()}, "XXX"...)
+		data = append(data, f.tag.encodeString("", true)...)
+		f.tag.addFrame("COMM", append(data, f.tag.encodeString(value, false)...))
+	case TagPodcast:
+		f.tag.setFrame("PCST", []byte{0, 0, 0, 1})
+	case TagYear:
+		if f.tag.version == 3 {
+			f.tag.setFrame("TYER", f.tag.encodeText(value))
+		} else {
+			f.tag.setFrame("TDRC", f.tag.encodeText(value))
+		}
+	default:
+		if id, found := id3TextFrames[field]; found {
+			f.tag.setFrame(id, f.tag.encodeText(value))
+		}
+	}
+}
+
+// setPicture replaces the front cover APIC frame, the other pictures are kept
+func (f *id3File) setPicture(artwork *Artwork) {
+	var frames []id3Frame
+	for _, frame := range f.tag.frames {
+		if frame.ID != "APIC" || apicPictureType(frame.Data) != 3 {
+			frames = append(frames, frame)
+		}
+	}
+	f.tag.frames = frames
+	f.tag.addFrame("APIC", f.tag.encodePicture(artwork.MediaType, 3, artwork.Content))
+}
+
+// apicPictureType is the picture type following the media type of an APIC frame
+func apicPictureType(data []byte) byte {
+	if len(data) < 2 {
+		return 0
+	}
+	end := bytes.IndexByte(data[1:], 0)
+	if end < 0 || 2+end >= len(data) {
+		return 0
+	}
+	return data[2+end]
+}
+
+func (f *id3File) length() time.Duration {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+	return mpegLength(file, f.audioOffset)
+}
+
+// save rewrites the ID3v2 tag, the audio data is copied unchanged
+func (f *id3File) save() error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err = file.Seek(f.audioOffset, io.SeekStart); err != nil {
+		return err
+	}
+	encoded := f.tag.encode()
+	err = writeFileAtomicWith(f.path, func(w io.Writer) error {
+		if _, err := w.Write(encoded); err != nil {
+			return err
+		}
+		_, err := io.Copy(w, file)
+		return err
+	})
+	if err == nil {
+		f.audioOffset = int64(len(encoded))
+	}
+	return err
+}
+
+// mpegBitrates are the layer III bitrates in kbit/s by bitrate index, for MPEG 1 and for MPEG 2 and 2.5
+var mpegBitrates = [2][15]int{
+	{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+}
+
+// mpegSampleRates are the sample rates by version bits and sample rate index
+var mpegSampleRates = [4][3]int{
+	{11025, 12000, 8000},
+	{},
+	{22050, 24000, 16000},
+	{44100, 48000, 32000},
+}
+
+// mpegLength is the duration of the MPEG layer III audio data, from the Xing or VBRI header of a VBR file
+// and from the bitrate of the first frame otherwise
+func mpegLength(file *os.File, audioOffset int64) time.Duration {
+	info, err := file.Stat()
+	if err != nil {
+		return 0
+	}
+	if _, err = file.Seek(audioOffset, io.SeekStart); err != nil {
+		return 0
+	}
+	data := make([]byte, 16*1024)
+	n, _ := io.ReadFull(file, data)
+	data = data[:n]
+	for i := 0; i+4 <= len(data); i++ {
+		if data[i] != 0xff || data[i+1]&0xe0 != 0xe0 {
+			continue
+		}
+		version := data[i+1] >> 3 & 3
+		layer := data[i+1] >> 1 & 3
+		bitrateIndex := data[i+2] >> 4
+		sampleRateIndex := data[i+2] >> 2 & 3
+		if version == 1 || layer != 1 || bitrateIndex == 0 || bitrateIndex == 15 || sampleRateIndex == 3 {
+			continue
+		}
+		mpeg1 := version == 3
+		mono := data[i+3]>>6 == 3
+		sampleRate := mpegSampleRates[version][sampleRateIndex]
+		samplesPerFrame, sideInformation, bitrates := 576, 17, mpegBitrates[1]
+		if mono {
+			sideInformation = 9
+		}
+		if mpeg1 {
+			samplesPerFrame, sideInformation, bitrates = 1152, 32, mpegBitrates[0]
+			if mono {
+				sideInformation = 17
+			}
+		}
+		frames := 0
+		if xing := i + 4 + sideInformation; xing+12 <= len(data) && (string(data[xing:xing+4]) == "Xing" || string(data[xing:xing+4]) == "Info") && data[xing+7]&1 != 0 {
+			frames = int(binary.BigEndian.Uint32(data[xing+8:]))
+		} else if vbri := i + 36; vbri+18 <= len(data) && string(data[vbri:vbri+4]) == "VBRI" {
+			frames = int(binary.BigEndian.Uint32(data[vbri+14:]))
+		}
+		if frames > 0 {
+			return time.Duration(int64(frames) * int64(samplesPerFrame) * int64(time.Second) / int64(sampleRate))
+		}
+		audioSize := info.Size() - audioOffset - int64(i)
+		return time.Duration(audioSize * 8 * int64(time.Second) / int64(bitrates[bitrateIndex]*1000))
+	}
+	return 0
+}
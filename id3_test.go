@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// id3Fixture encodes an ID3v2 tag with its frames and some padding, the extended header is written when asked
+func id3Fixture(version byte, extended bool, frames ...id3Frame) []byte {
+	var content []byte
+	flags := byte(0)
+	if extended {
+		flags |= 0x40
+		if version == 4 {
+			content = append(content, 0, 0, 0, 6, 1, 0)
+		} else {
+			content = append(content, 0, 0, 0, 6, 0, 0, 0, 0, 0, 0)
+		}
+	}
+	for _, frame := range frames {
+		header := make([]byte, 10)
+		copy(header, frame.ID)
+		if version == 4 {
+			putSyncsafe(header[4:], len(frame.Data))
+		} else {
+			binary.BigEndian.PutUint32(header[4:], uint32(len(frame.Data)))
+		}
+		content = append(append(content, header...), frame.Data...)
+	}
+	content = append(content, make([]byte, 16)...)
+	header := []byte{'I', 'D', '3', version, 0, flags, 0, 0, 0, 0}
+	putSyncsafe(header[6:], len(content))
+	return append(header, content...)
+}
+
+func writeFixture(t *testing.T, name string, content []byte) string {
+	folder, err := ioutil.TempDir("", "goblackpodder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(folder, name)
+	if err = ioutil.WriteFile(path, content, 0666); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSyncsafe(t *testing.T) {
+	b := make([]byte, 4)
+	putSyncsafe(b, 300)
+	if !bytes.Equal(b, []byte{0, 0, 2, 0x2c}) {
+		t.Fatalf("Unexpected sync-safe encoding %v", b)
+	}
+	for _, value := range []int{0, 127, 128, 16383, 1 << 20, 0x0fffffff} {
+		putSyncsafe(b, value)
+		if (b[0]|b[1]|b[2]|b[3])&0x80 != 0 || syncsafe(b) != value {
+			t.Fatalf("Sync-safe round trip failure for %d : %v", value, b)
+		}
+	}
+}
+
+func TestID3RoundTrip(t *testing.T) {
+	logger = NewLogger(false)
+	audio := []byte("\xff\xfbaudio data")
+	// a frame larger than 127 bytes has different plain and sync-safe sizes
+	comment := strings.Repeat("c", 200)
+	for _, version := range []byte{3, 4} {
+		for _, extended := range []bool{false, true} {
+			tag := &id3Tag{version: version}
+			fixture := id3Fixture(version, extended,
+				id3Frame{ID: "TIT2", Data: tag.encodeText("Old title")},
+				id3Frame{ID: "TXXX", Data: tag.encodeText(comment)},
+			)
+			path := writeFixture(t, "episode.mp3", append(fixture, audio...))
+			defer os.RemoveAll(filepath.Dir(path))
+
+			f, err := openID3File(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.audioOffset != int64(len(fixture)) || len(f.tag.frames) != 2 || f.tag.frames[1].ID != "TXXX" {
+				t.Fatalf("ID3v2.%d tag badly read, extended header %v : %+v", version, extended, f.tag.frames)
+			}
+			f.setTag(TagTitle, "New title")
+			if err = f.save(); err != nil {
+				t.Fatal(err)
+			}
+
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if content[3] != version || content[5] != 0 {
+				t.Fatalf("Unexpected ID3v2 header %v", content[:10])
+			}
+			if !bytes.HasSuffix(content, audio) || int64(len(content)-len(audio)) != f.audioOffset {
+				t.Fatalf("ID3v2.%d audio data moved", version)
+			}
+			saved, audioOffset, err := readID3Tag(bytes.NewReader(content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if audioOffset != f.audioOffset || len(saved.frames) != 2 {
+				t.Fatalf("ID3v2.%d tag badly written : %+v", version, saved.frames)
+			}
+			if !bytes.Equal(saved.frames[0].Data, tag.encodeText("New title")) || !bytes.Equal(saved.frames[1].Data, tag.encodeText(comment)) {
+				t.Fatalf("ID3v2.%d frames badly written : %+v", version, saved.frames)
+			}
+		}
+	}
+}
+
+func TestID3UnsupportedVersion(t *testing.T) {
+	fixture := id3Fixture(2, false)
+	if _, _, err := readID3Tag(bytes.NewReader(fixture)); err == nil {
+		t.Fatal("ID3v2.2 tag accepted")
+	}
+}
@@ -4,6 +4,7 @@ import (
 
 	//"github.com/nfnt/resize"
 	"image"
+	"image/color"
 	"image/gif"
 	"image/jpeg"
 	"image/png"
@@ -35,6 +36,41 @@ func Formatjpg(img image.Image, filepath string) (err error) {
 
 }
 
+//ResizeImage scales the image down to fit in a maxSize square, each pixel is the average of the source pixels it covers
+func ResizeImage(img image.Image, maxSize int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if maxSize <= 0 || width <= maxSize && height <= maxSize {
+		return img
+	}
+	targetWidth, targetHeight := maxSize, height*maxSize/width
+	if height > width {
+		targetWidth, targetHeight = width*maxSize/height, maxSize
+	}
+	if targetWidth < 1 {
+		targetWidth = 1
+	}
+	if targetHeight < 1 {
+		targetHeight = 1
+	}
+	resized := image.NewRGBA(image.Rect(0, 0, targetWidth, targetHeight))
+	for y := 0; y < targetHeight; y++ {
+		top, bottom := bounds.Min.Y+y*height/targetHeight, bounds.Min.Y+(y+1)*height/targetHeight
+		for x := 0; x < targetWidth; x++ {
+			left, right := bounds.Min.X+x*width/targetWidth, bounds.Min.X+(x+1)*width/targetWidth
+			var r, g, b, a, count uint64
+			for sy := top; sy < bottom; sy++ {
+				for sx := left; sx < right; sx++ {
+					pr, pg, pb, pa := img.At(sx, sy).RGBA()
+					r, g, b, a, count = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa), count+1
+				}
+			}
+			resized.Set(x, y, color.RGBA64{R: uint16(r / count), G: uint16(g / count), B: uint16(b / count), A: uint16(a / count)})
+		}
+	}
+	return resized
+}
+
 //Formatgif encodes the image
 func Formatgif(img image.Image, filepath string) (err error) {
 	out, err := os.Create(filepath)
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	rss "github.com/jteeuwen/go-pkg-rss"
+)
+
+// ItunesNamespace is the iTunes podcast extension namespace
+const ItunesNamespace string = "http://www.itunes.com/dtds/podcast-1.0.dtd"
+
+func itunesElement(extensions map[string]map[string][]rss.Extension, name string) (rss.Extension, bool) {
+	values := extensions[ItunesNamespace][name]
+	if len(values) == 0 {
+		return rss.Extension{}, false
+	}
+	return values[0], true
+}
+
+func itunesValue(extensions map[string]map[string][]rss.Extension, name string) string {
+	element, _ := itunesElement(extensions, name)
+	return strings.TrimSpace(element.Value)
+}
+
+func itunesImage(extensions map[string]map[string][]rss.Extension) string {
+	element, _ := itunesElement(extensions, "image")
+	return strings.TrimSpace(element.Attrs["href"])
+}
+
+func extensionNumber(extensions map[string]map[string][]rss.Extension, namespace string, name string) (float64, bool) {
+	values := extensions[namespace][name]
+	if len(values) == 0 {
+		return 0, false
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(values[0].Value), 64)
+	return value, err == nil
+}
+
+func itunesFlag(extensions map[string]map[string][]rss.Extension, name string) (flag bool, found bool) {
+	value := strings.ToLower(itunesValue(extensions, name))
+	return value == "yes" || value == "true" || value == "explicit", value != ""
+}
+
+// itunes is the value of the itunes extension element of the episode
+func (e Episode) itunes(name string) string {
+	return itunesValue(e.feedEpisode.Extensions, name)
+}
+
+// explicit tells if the episode is flagged as explicit (itunes:explicit), the podcast flag is used when the episode has none
+func (e Episode) explicit() bool {
+	if explicit, found := itunesFlag(e.feedEpisode.Extensions, "explicit"); found {
+		return explicit
+	}
+	return e.Podcast != nil && e.Podcast.explicit()
+}
+
+// duration is the itunes:duration of the episode ([[HH:]MM:]SS), 0 when unknown
+func (e Episode) duration() time.Duration {
+	seconds, ok := parseClockTime(e.itunes("duration"))
+	if !ok {
+		return 0
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// parseClockTime reads a [[HH:]MM:]SS[.mmm] time in seconds
+func parseClockTime(value string) (float64, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	var seconds float64
+	for _, part := range strings.Split(value, ":") {
+		value, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return 0, false
+		}
+		seconds = seconds*60 + value
+	}
+	return seconds, true
+}
+
+// image is the itunes:image of the episode
+func (e Episode) image() string {
+	return itunesImage(e.feedEpisode.Extensions)
+}
+
+// author is the itunes:author of the episode, the podcast author when the episode has none
+func (e Episode) author() string {
+	if author := e.itunes("author"); author != "" {
+		return author
+	}
+	if e.feedEpisode.Author.Name != "" {
+		return e.feedEpisode.Author.Name
+	}
+	if e.Podcast != nil {
+		return e.Podcast.author()
+	}
+	return ""
+}
+
+// summary is the itunes:summary of the episode
+func (e Episode) summary() string {
+	return e.itunes("summary")
+}
+
+// keywords are the itunes:keywords of the episode, the podcast keywords when the episode has none
+func (e Episode) keywords() string {
+	if keywords := e.itunes("keywords"); keywords != "" || e.Podcast == nil {
+		return keywords
+	}
+	return itunesValue(e.Podcast.feedPodcast.Extensions, "keywords")
+}
+
+// episodeType is the itunes:episodeType of the episode : full, trailer or bonus
+func (e Episode) episodeType() string {
+	if episodeType := strings.ToLower(e.itunes("episodeType")); episodeType != "" {
+		return episodeType
+	}
+	return "full"
+}
+
+// numbers are the season and episode numbers of the episode, from the itunes namespace then from the podcast namespace
+func (e Episode) numbers() (season int, episode int) {
+	return itemNumbers(e.feedEpisode)
+}
+
+// blocked tells if the episode must not be listed by the podcast directories (itunes:block)
+func (e Episode) blocked() bool {
+	blocked, _ := itunesFlag(e.feedEpisode.Extensions, "block")
+	return blocked
+}
+
+func itemNumbers(item *rss.Item) (season int, episode int) {
+	for _, namespace := range []string{ItunesNamespace, PodcastNamespace} {
+		if value, ok := extensionNumber(item.Extensions, namespace, "season"); ok && season == 0 {
+			season = int(value)
+		}
+		if value, ok := extensionNumber(item.Extensions, namespace, "episode"); ok && episode == 0 {
+			episode = int(value)
+		}
+	}
+	return season, episode
+}
+
+// imageURL is the podcast artwork url, the rss image first then the itunes:image
+func (podcast Podcast) imageURL() string {
+	if podcast.feedPodcast.Image.Url != "" {
+		return podcast.feedPodcast.Image.Url
+	}
+	return itunesImage(podcast.feedPodcast.Extensions)
+}
+
+// author is the itunes:author of the podcast
+func (podcast Podcast) author() string {
+	if author := itunesValue(podcast.feedPodcast.Extensions, "author"); author != "" {
+		return author
+	}
+	return podcast.feedPodcast.Author.Name
+}
+
+// summary is the itunes:summary of the podcast
+func (podcast Podcast) summary() string {
+	return itunesValue(podcast.feedPodcast.Extensions, "summary")
+}
+
+// explicit tells if the podcast is flagged as explicit (itunes:explicit)
+func (podcast Podcast) explicit() bool {
+	explicit, _ := itunesFlag(podcast.feedPodcast.Extensions, "explicit")
+	return explicit
+}
+
+// categories are the itunes:category of the podcast, a subcategory is joined to its category with a slash
+func (podcast Podcast) categories() []string {
+	var categories []string
+	for _, category := range podcast.feedPodcast.Extensions[ItunesNamespace]["category"] {
+		name := category.Attrs["text"]
+		if name == "" {
+			continue
+		}
+		subcategories := category.Childrens["category"]
+		if len(subcategories) == 0 {
+			categories = append(categories, name)
+		}
+		for _, subcategory := range subcategories {
+			categories = append(categories, name+"/"+subcategory.Attrs["text"])
+		}
+	}
+	return categories
+}
+
+// newFeedURL is the new location of a moved podcast (itunes:new-feed-url)
+func (podcast Podcast) newFeedURL() string {
+	return itunesValue(podcast.feedPodcast.Extensions, "new-feed-url")
+}
+
+// blocked tells if the podcast must not be listed by the podcast directories (itunes:block)
+func (podcast Podcast) blocked() bool {
+	blocked, _ := itunesFlag(podcast.feedPodcast.Extensions, "block")
+	return blocked
+}
+
+// complete tells if no more episodes will ever be published (itunes:complete)
+func (podcast Podcast) complete() bool {
+	complete, _ := itunesFlag(podcast.feedPodcast.Extensions, "complete")
+	return complete
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// mp4Containers are the atoms whose children are parsed to reach the metadata and the chunk offsets
+var mp4Containers = []string{"moov", "trak", "mdia", "minf", "stbl", "udta", "meta", "ilst"}
+
+// mp4Atom is a mp4 atom, the data of a container atom is the header before its children (version and flags of a meta atom)
+type mp4Atom struct {
+	kind     string
+	data     []byte
+	children []*mp4Atom
+}
+
+// mp4TopLevelAtom is an atom of the file, only the moov atom is read in memory
+type mp4TopLevelAtom struct {
+	kind   string
+	offset int64
+	size   int64
+}
+
+// mp4ItemAtoms are the iTunes metadata items of the episode tags
+var mp4ItemAtoms = map[TagField]string{
+	TagTitle:   "\xa9nam",
+	TagArtist:  "\xa9ART",
+	TagAlbum:   "\xa9alb",
+	TagComment: "\xa9cmt",
+	TagGenre:   "\xa9gen",
+	TagTrack:   "trkn",
+	TagYear:    "\xa9day",
+
+	TagAlbumArtist: "aART",
+	TagDisc:        "disk",
+	TagPodcast:     "pcst",
+	TagFeedURL:     "purl",
+	TagEpisodeID:   "egid",
+	TagDescription: "ldes",
+	TagCategory:    "catg",
+	TagKeywords:    "keyw",
+}
+
+// parseMP4Atoms parses the atoms of the data, the metadata items of an ilst parent are containers of data atoms
+func parseMP4Atoms(data []byte, parent string) ([]*mp4Atom, error) {
+	var atoms []*mp4Atom
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, errors.New("Invalid mp4 atom")
+		}
+		size, headerSize := uint64(binary.BigEndian.Uint32(data)), uint64(8)
+		switch {
+		case size == 0:
+			size = uint64(len(data))
+		case size == 1 && len(data) >= 16:
+			size, headerSize = binary.BigEndian.Uint64(data[8:]), 16
+		}
+		if size < headerSize || size > uint64(len(data)) {
+			return nil, errors.New("Invalid mp4 atom size : " + string(data[4:8]))
+		}
+		atom := &mp4Atom{kind: string(data[4:8]), data: data[headerSize:size]}
+		if containsString(mp4Containers, atom.kind) || parent == "ilst" {
+			payload := atom.data
+			prefix := 0
+			if atom.kind == "meta" && !(len(payload) >= 8 && string(payload[4:8]) == "hdlr") {
+				prefix = 4
+			}
+			if len(payload) < prefix {
+				return nil, errors.New("Invalid mp4 meta atom")
+			}
+			children, err := parseMP4Atoms(payload[prefix:], atom.kind)
+			if err != nil {
+				return nil, err
+			}
+			atom.data, atom.children = payload[:prefix], children
+		}
+		atoms = append(atoms, atom)
+		data = data[size:]
+	}
+	return atoms, nil
+}
+
+func (atom *mp4Atom) encode() []byte {
+	payload := append([]byte{}, atom.data...)
+	for _, child := range atom.children {
+		payload = append(payload, child.encode()...)
+	}
+	encoded := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(encoded, uint32(8+len(payload)))
+	copy(encoded[4:], atom.kind)
+	return append(encoded, payload...)
+}
+
+func (atom *mp4Atom) child(kind string) *mp4Atom {
+	for _, child := range atom.children {
+		if child.kind == kind {
+			return child
+		}
+	}
+	return nil
+}
+
+// setChild replaces the first child atom of the same kind, the atom is appended when there is none
+func (atom *mp4Atom) setChild(child *mp4Atom) {
+	for i, existing := range atom.children {
+		if existing.kind == child.kind {
+			atom.children[i] = child
+			return
+		}
+	}
+	atom.children = append(atom.children, child)
+}
+
+// childOrNew returns the child atom of the kind, a new empty one is appended when there is none
+func (atom *mp4Atom) childOrNew(kind string, data []byte) *mp4Atom {
+	if child := atom.child(kind); child != nil {
+		return child
+	}
+	child := &mp4Atom{kind: kind, data: data}
+	atom.children = append(atom.children, child)
+	return child
+}
+
+// walk calls the function for the atom and all its descendants
+func (atom *mp4Atom) walk(function func(atom *mp4Atom) error) error {
+	if err := function(atom); err != nil {
+		return err
+	}
+	for _, child := range atom.children {
+		if err := child.walk(function); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mp4File is a mp4 file with its iTunes metadata
+type mp4File struct {
+	path   string
+	atoms  []mp4TopLevelAtom
+	moov   *mp4Atom
+	moovAt int
+}
+
+func openMP4File(path string) (*mp4File, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	f := &mp4File{path: path, moovAt: -1}
+	header := make([]byte, 16)
+	for offset := int64(0); offset < info.Size(); {
+		if _, err = file.ReadAt(header[:8], offset); err != nil {
+			return nil, err
+		}
+		atom := mp4TopLevelAtom{kind: string(header[4:8]), offset: offset, size: int64(binary.BigEndian.Uint32(header))}
+		switch atom.size {
+		case 0:
+			atom.size = info.Size() - offset
+		case 1:
+			if _, err = file.ReadAt(header[8:], offset+8); err != nil {
+				return nil, err
+			}
+			atom.size = int64(binary.BigEndian.Uint64(header[8:]))
+		}
+		if atom.size < 8 || offset+atom.size > info.Size() {
+			return nil, errors.New("Invalid mp4 atom size : " + atom.kind)
+		}
+		if atom.kind == "moov" {
+			content := make([]byte, atom.size)
+			if _, err = file.ReadAt(content, offset); err != nil {
+				return nil, err
+			}
+			atoms, err := parseMP4Atoms(content, "")
+			if err != nil {
+				return nil, err
+			}
+			f.moov, f.moovAt = atoms[0], len(f.atoms)
+		}
+		f.atoms = append(f.atoms, atom)
+		offset += atom.size
+	}
+	if f.moov == nil {
+		return nil, errors.New("No moov atom : " + path)
+	}
+	return f, nil
+}
+
+// items is the ilst atom of the iTunes metadata, created with its handler when missing
+func (f *mp4File) items() *mp4Atom {
+	meta := f.moov.childOrNew("udta", nil).childOrNew("meta", make([]byte, 4))
+	if meta.child("hdlr") == nil {
+		handler := make([]byte, 25)
+		copy(handler[8:], "mdir")
+		copy(handler[12:], "appl")
+		meta.children = append([]*mp4Atom{{kind: "hdlr", data: handler}}, meta.children...)
+	}
+	return meta.childOrNew("ilst", nil)
+}
+
+func (f *mp4File) setTag(field TagField, value string) {
+	kind, found := mp4ItemAtoms[field]
+	if !found {
+		return
+	}
+	var data []byte
+	switch field {
+	case TagTrack, TagDisc:
+		number, _ := parseTrackNumber(value)
+		data = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, byte(number >> 8), byte(number), 0, 0}
+		if field == TagTrack {
+			data = append(data, 0, 0)
+		}
+	case TagPodcast:
+		data = []byte{0, 0, 0, 21, 0, 0, 0, 0, 1}
+	default:
+		data = append([]byte{0, 0, 0, 1, 0, 0, 0, 0}, value...)
+	}
+	f.items().setChild(&mp4Atom{kind: kind, children: []*mp4Atom{{kind: "data", data: data}}})
+}
+
+// setPicture replaces the covr item with the artwork
+func (f *mp4File) setPicture(artwork *Artwork) {
+	dataType := byte(13)
+	if artwork.MediaType == "image/png" {
+		dataType = 14
+	}
+	data := append([]byte{0, 0, 0, dataType, 0, 0, 0, 0}, artwork.Content...)
+	f.items().setChild(&mp4Atom{kind: "covr", children: []*mp4Atom{{kind: "data", data: data}}})
+}
+
+// length is the duration of the movie header
+func (f *mp4File) length() time.Duration {
+	header := f.moov.child("mvhd")
+	if header == nil || len(header.data) < 20 {
+		return 0
+	}
+	data := header.data
+	var timescale, duration uint64
+	if data[0] == 1 {
+		if len(data) < 32 {
+			return 0
+		}
+		timescale, duration = uint64(binary.BigEndian.Uint32(data[20:])), binary.BigEndian.Uint64(data[24:])
+	} else {
+		timescale, duration = uint64(binary.BigEndian.Uint32(data[12:])), uint64(binary.BigEndian.Uint32(data[16:]))
+	}
+	if timescale == 0 {
+		return 0
+	}
+	return time.Duration(duration * uint64(time.Second) / timescale)
+}
+
+// shiftChunkOffsets moves the chunk offsets located after the moov atom when the moov atom size changes
+func (f *mp4File) shiftChunkOffsets(from int64, shift int64) error {
+	return f.moov.walk(func(atom *mp4Atom) error {
+		if (atom.kind != "stco" && atom.kind != "co64") || len(atom.data) < 8 {
+			return nil
+		}
+		entrySize := 4
+		if atom.kind == "co64" {
+			entrySize = 8
+		}
+		count := int(binary.BigEndian.Uint32(atom.data[4:]))
+		if 8+count*entrySize > len(atom.data) {
+			return errors.New("Invalid mp4 chunk offset table")
+		}
+		for i := 0; i < count; i++ {
+			entry := atom.data[8+i*entrySize:]
+			if entrySize == 8 {
+				if offset := int64(binary.BigEndian.Uint64(entry)); offset >= from {
+					binary.BigEndian.PutUint64(entry, uint64(offset+shift))
+				}
+				continue
+			}
+			offset := int64(binary.BigEndian.Uint32(entry))
+			if offset >= from {
+				if offset+shift > 0xffffffff {
+					return errors.New("mp4 chunk offset overflow")
+				}
+				binary.BigEndian.PutUint32(entry, uint32(offset+shift))
+			}
+		}
+		return nil
+	})
+}
+
+// save rewrites the file with the updated moov atom, the other atoms are copied unchanged
+func (f *mp4File) save() error {
+	moov := f.atoms[f.moovAt]
+	encoded := f.moov.encode()
+	if shift := int64(len(encoded)) - moov.size; shift != 0 {
+		if err := f.shiftChunkOffsets(moov.offset+moov.size, shift); err != nil {
+			return err
+		}
+		encoded = f.moov.encode()
+	}
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	err = writeFileAtomicWith(f.path, func(w io.Writer) error {
+		for i, atom := range f.atoms {
+			if i == f.moovAt {
+				if _, err := w.Write(encoded); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, err := io.Copy(w, io.NewSectionReader(file, atom.offset, atom.size)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	reopened, err := openMP4File(f.path)
+	if err == nil {
+		*f = *reopened
+	}
+	return err
+}
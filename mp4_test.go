@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func mp4Box(kind string, payload ...[]byte) []byte {
+	content := bytes.Join(payload, nil)
+	box := make([]byte, 8, 8+len(content))
+	binary.BigEndian.PutUint32(box, uint32(8+len(content)))
+	copy(box[4:], kind)
+	return append(box, content...)
+}
+
+// mp4ChunkOffsets is a stco or co64 atom with the offsets
+func mp4ChunkOffsets(kind string, offsets ...int64) []byte {
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint32(payload[4:], uint32(len(offsets)))
+	for _, offset := range offsets {
+		entry := make([]byte, 8)
+		if kind == "co64" {
+			binary.BigEndian.PutUint64(entry, uint64(offset))
+		} else {
+			entry = entry[:4]
+			binary.BigEndian.PutUint32(entry, uint32(offset))
+		}
+		payload = append(payload, entry...)
+	}
+	return mp4Box(kind, payload)
+}
+
+// mp4Fixture encodes a mp4 file with 2 tracks, one with 32 bits chunk offsets and one with 64 bits ones,
+// the offsets point to the chunks of the mdat atom
+func mp4Fixture(moovFirst bool, chunks [][]byte) []byte {
+	ftyp := mp4Box("ftyp", []byte("M4A \x00\x00\x00\x00"))
+	header := make([]byte, 100)
+	binary.BigEndian.PutUint32(header[12:], 1000)
+	binary.BigEndian.PutUint32(header[16:], 5000)
+	moov := func(base int64) []byte {
+		var offsets []int64
+		for _, chunk := range chunks {
+			offsets = append(offsets, base)
+			base += int64(len(chunk))
+		}
+		track := func(table []byte) []byte {
+			return mp4Box("trak", mp4Box("mdia", mp4Box("minf", mp4Box("stbl", table))))
+		}
+		return mp4Box("moov", mp4Box("mvhd", header), track(mp4ChunkOffsets("stco", offsets...)), track(mp4ChunkOffsets("co64", offsets...)))
+	}
+	mdat := mp4Box("mdat", chunks...)
+	if moovFirst {
+		return bytes.Join([][]byte{ftyp, moov(int64(len(ftyp) + len(moov(0)) + 8)), mdat}, nil)
+	}
+	return bytes.Join([][]byte{ftyp, mdat, moov(int64(len(ftyp) + 8))}, nil)
+}
+
+func TestMP4RoundTrip(t *testing.T) {
+	logger = NewLogger(false)
+	chunks := [][]byte{bytes.Repeat([]byte{1}, 20), bytes.Repeat([]byte{2}, 30), bytes.Repeat([]byte{3}, 10)}
+	for _, moovFirst := range []bool{true, false} {
+		path := writeFixture(t, "episode.m4a", mp4Fixture(moovFirst, chunks))
+		defer os.RemoveAll(filepath.Dir(path))
+
+		f, err := openMP4File(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.length().Seconds() != 5 {
+			t.Fatalf("Unexpected mp4 length %v", f.length())
+		}
+		f.setTag(TagTitle, "New title")
+		f.setTag(TagPodcast, "")
+		if err = f.save(); err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reopened, err := openMP4File(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		title := reopened.items().child("\xa9nam")
+		if title == nil || string(title.children[0].data[8:]) != "New title" {
+			t.Fatalf("mp4 title badly written")
+		}
+		tables := 0
+		reopened.moov.walk(func(atom *mp4Atom) error {
+			if atom.kind != "stco" && atom.kind != "co64" {
+				return nil
+			}
+			tables++
+			for i, chunk := range chunks {
+				var offset int64
+				if atom.kind == "co64" {
+					offset = int64(binary.BigEndian.Uint64(atom.data[8+i*8:]))
+				} else {
+					offset = int64(binary.BigEndian.Uint32(atom.data[8+i*4:]))
+				}
+				if offset+int64(len(chunk)) > int64(len(content)) || !bytes.Equal(content[offset:offset+int64(len(chunk))], chunk) {
+					t.Fatalf("%s chunk %d not found at its offset %d, moov first %v", atom.kind, i, offset, moovFirst)
+				}
+			}
+			return nil
+		})
+		if tables != 2 {
+			t.Fatalf("%d chunk offset tables instead of 2", tables)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// MPDPlaylistPrefix is the prefix of the MPD stored playlist of each podcast
+const MPDPlaylistPrefix string = "Podcast - "
+
+// MPDCommandTimeout is the default max duration of a MPD command, a hung MPD never blocks the run
+const MPDCommandTimeout = 30 * time.Second
+
+// MPDClient is a minimal Music Player Daemon protocol client
+type MPDClient struct {
+	conn    io.ReadWriteCloser
+	reader  *bufio.Reader
+	timeout time.Duration
+}
+
+// MPDAttribute is a "key: value" line of a MPD response
+type MPDAttribute struct {
+	Key   string
+	Value string
+}
+
+// MPDResponse is the list of attributes returned by a MPD command
+type MPDResponse []MPDAttribute
+
+func (r MPDResponse) get(key string) (string, bool) {
+	for _, attribute := range r {
+		if attribute.Key == key {
+			return attribute.Value, true
+		}
+	}
+	return "", false
+}
+
+// MPDError is an ACK response of MPD
+type MPDError struct {
+	Message string
+}
+
+func (e *MPDError) Error() string {
+	return "MPD error : " + e.Message
+}
+
+// DialMPD connects to MPD with a tcp address or a unix socket path
+func DialMPD(address string, password string, timeout time.Duration) (*MPDClient, error) {
+	network := "tcp"
+	if strings.HasPrefix(address, "/") {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	client, err := NewMPDClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err = client.authenticate(password); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// NewMPDClient makes a new client over an established connection, the MPD greeting is checked
+func NewMPDClient(conn io.ReadWriteCloser) (*MPDClient, error) {
+	client := &MPDClient{conn: conn, reader: bufio.NewReader(conn), timeout: MPDCommandTimeout}
+	client.setDeadline()
+	greeting, err := client.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(greeting, "OK MPD") {
+		return nil, errors.New("Unexpected MPD greeting : " + strings.TrimSpace(greeting))
+	}
+	return client, nil
+}
+
+// Close ends the MPD session
+func (c *MPDClient) Close() error {
+	c.setDeadline()
+	io.WriteString(c.conn, "close\n")
+	return c.conn.Close()
+}
+
+// authenticate sends the password, no password means no authentication
+func (c *MPDClient) authenticate(password string) error {
+	if password == "" {
+		return nil
+	}
+	_, err := c.Command("password", password)
+	return err
+}
+
+// setDeadline limits the duration of the next exchange when the connection supports deadlines
+func (c *MPDClient) setDeadline() {
+	if conn, ok := c.conn.(interface{ SetDeadline(time.Time) error }); ok && c.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+}
+
+// Command sends a command with its quoted arguments and reads the response
+func (c *MPDClient) Command(name string, args ...string) (MPDResponse, error) {
+	line := name
+	for _, arg := range args {
+		line += " \"" + strings.Replace(strings.Replace(arg, "\\", "\\\\", -1), "\"", "\\\"", -1) + "\""
+	}
+	logger.Debug.Println("MPD command : " + name)
+	c.setDeadline()
+	if _, err := io.WriteString(c.conn, line+"\n"); err != nil {
+		return nil, err
+	}
+
+	var response MPDResponse
+	for {
+		responseLine, err := c.reader.ReadString('\n')
+		if err != nil {
+			return response, err
+		}
+		responseLine = strings.TrimSuffix(responseLine, "\n")
+		switch {
+		case responseLine == "OK":
+			return response, nil
+		case strings.HasPrefix(responseLine, "ACK "):
+			return response, &MPDError{Message: strings.TrimPrefix(responseLine, "ACK ")}
+		}
+		tokens := strings.SplitN(responseLine, ": ", 2)
+		if len(tokens) == 2 {
+			response = append(response, MPDAttribute{Key: tokens[0], Value: tokens[1]})
+		}
+	}
+}
+
+// waitForUpdate polls the MPD status until the database update is finished
+func (c *MPDClient) waitForUpdate(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		status, err := c.Command("status")
+		if err != nil {
+			return err
+		}
+		if _, updating := status.get("updating_db"); !updating {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.New("MPD database update timeout")
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// replacePlaylist replaces the content of a MPD stored playlist, it is created if needed.
+// The episodes refused by MPD (not indexed yet or excluded) are skipped.
+func (c *MPDClient) replacePlaylist(name string, uris []string) error {
+	if _, err := c.Command("rm", name); err != nil {
+		if _, ack := err.(*MPDError); !ack {
+			return err
+		}
+	}
+	for _, uri := range uris {
+		if _, err := c.Command("playlistadd", name, uri); err != nil {
+			if _, ack := err.(*MPDError); !ack {
+				return err
+			}
+			logger.Warning.Println("Episode not added to the MPD playlist "+name+" : "+uri, err)
+		}
+	}
+	return nil
+}
+
+// mpdMusicDirectory is the local path of the MPD music directory, the MPD uris are relative to it
+func mpdMusicDirectory() string {
+	if folder := viper.GetString("mpdMusicDirectory"); folder != "" {
+		return folder
+	}
+	return targetFolder
+}
+
+func mpdURI(path string) (string, error) {
+	uri, err := filepath.Rel(mpdMusicDirectory(), path)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(uri, "..") {
+		return "", errors.New(path + " is not in the MPD music directory " + mpdMusicDirectory())
+	}
+	if uri == "." {
+		uri = ""
+	}
+	return filepath.ToSlash(uri), nil
+}
+
+// updateMPD refreshes the MPD database with the podcast folder and updates the podcast playlists
+func updateMPD(newEpisodeFiles []string) {
+	host := viper.GetString("mpdHost")
+	if host == "" {
+		return
+	}
+	address := host
+	if !strings.HasPrefix(host, "/") {
+		address = net.JoinHostPort(host, strconv.Itoa(viper.GetInt("mpdPort")))
+	}
+	client, err := DialMPD(address, viper.GetString("mpdPassword"), 10*time.Second)
+	if err != nil {
+		logger.Error.Println("Cannot connect to MPD "+address, err)
+		return
+	}
+	defer client.Close()
+
+	if err = syncMPD(client, newEpisodeFiles); err != nil {
+		logger.Error.Println("MPD update failure", err)
+		return
+	}
+	logger.Info.Println("MPD updated")
+}
+
+func syncMPD(client *MPDClient, newEpisodeFiles []string) error {
+	podcastURI, err := mpdURI(targetFolder)
+	if err != nil {
+		return err
+	}
+	if podcastURI == "" {
+		_, err = client.Command("update")
+	} else {
+		_, err = client.Command("update", podcastURI)
+	}
+	if err != nil {
+		return err
+	}
+	if err = client.waitForUpdate(viper.GetDuration("mpdUpdateTimeout")); err != nil {
+		return err
+	}
+
+	var newURIs []string
+	for _, file := range newEpisodeFiles {
+		uri, err := mpdURI(file)
+		if err != nil {
+			logger.Warning.Println("New episode ignored by MPD", err)
+			continue
+		}
+		newURIs = append(newURIs, uri)
+	}
+	if len(newURIs) > 0 {
+		if err = client.replacePlaylist(viper.GetString("mpdNewPlaylist"), newURIs); err != nil {
+			return err
+		}
+		if viper.GetBool("mpdQueue") {
+			for _, uri := range newURIs {
+				if _, err = client.Command("add", uri); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	folders, err := ioutil.ReadDir(targetFolder)
+	if err != nil {
+		return err
+	}
+	for _, folder := range folders {
+		if !folder.IsDir() || strings.HasPrefix(folder.Name(), ".") {
+			continue
+		}
+		episodeFiles := listEpisodeFiles(filepath.Join(targetFolder, folder.Name()))
+		var uris []string
+		for _, file := range episodeFiles {
+			if uri, err := mpdURI(file); err == nil {
+				uris = append(uris, uri)
+			}
+		}
+		if len(uris) > 0 {
+			if err = client.replacePlaylist(MPDPlaylistPrefix+folder.Name(), uris); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// listEpisodeFiles lists the episode files of a podcast folder, the newest first
+func listEpisodeFiles(folder string) []string {
+	var episodeFiles []string
+	files := podcastFiles(folder, states.recordsByPath())
+	sortNewestFirst(files)
+	for _, file := range files {
+		episodeFiles = append(episodeFiles, file.Path)
+	}
+	return episodeFiles
+}
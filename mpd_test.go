@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mpdExchange is a command expected by the fake MPD server and its response
+type mpdExchange struct {
+	request  string
+	response string
+}
+
+// fakeMPD connects a client to a fake MPD server over a pipe, the server answers the expected commands in order
+func fakeMPD(t *testing.T, exchanges []mpdExchange) *MPDClient {
+	logger = NewLogger(false)
+	server, conn := net.Pipe()
+	go func() {
+		defer server.Close()
+		reader := bufio.NewReader(server)
+		io.WriteString(server, "OK MPD 0.23.5\n")
+		for _, exchange := range exchanges {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if line = strings.TrimSuffix(line, "\n"); line != exchange.request {
+				t.Errorf("Unexpected MPD command %q, expected %q", line, exchange.request)
+				return
+			}
+			io.WriteString(server, exchange.response)
+		}
+		reader.ReadString('\n')
+	}()
+	client, err := NewMPDClient(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestMPDGreeting(t *testing.T) {
+	logger = NewLogger(false)
+	server, conn := net.Pipe()
+	go func() {
+		io.WriteString(server, "Welcome\n")
+		server.Close()
+	}()
+	if _, err := NewMPDClient(conn); err == nil {
+		t.Fatal("Unexpected greeting accepted")
+	}
+}
+
+func TestMPDPassword(t *testing.T) {
+	client := fakeMPD(t, []mpdExchange{
+		{`password "se\"cret"`, "OK\n"},
+		{`password "wrong"`, "ACK [3@0] {password} incorrect password\n"},
+	})
+	defer client.Close()
+	if err := client.authenticate(""); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.authenticate(`se"cret`); err != nil {
+		t.Fatal(err)
+	}
+	err := client.authenticate("wrong")
+	if _, ack := err.(*MPDError); !ack {
+		t.Fatalf("Expected an MPD error, got %v", err)
+	}
+}
+
+func TestMPDAck(t *testing.T) {
+	client := fakeMPD(t, []mpdExchange{
+		{`update "podcasts"`, "ACK [50@0] {update} Malformed path\n"},
+		{"status", "volume: -1\nstate: stop\nOK\n"},
+	})
+	defer client.Close()
+	_, err := client.Command("update", "podcasts")
+	mpdErr, ack := err.(*MPDError)
+	if !ack || mpdErr.Message != "[50@0] {update} Malformed path" {
+		t.Fatalf("Expected an MPD error, got %v", err)
+	}
+	status, err := client.Command("status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := status.get("state"); state != "stop" {
+		t.Fatalf("Unexpected status %v", status)
+	}
+}
+
+func TestMPDWaitForUpdate(t *testing.T) {
+	client := fakeMPD(t, []mpdExchange{
+		{`update "podcasts"`, "updating_db: 4\nOK\n"},
+		{"status", "state: stop\nupdating_db: 4\nOK\n"},
+		{"status", "state: stop\nOK\n"},
+	})
+	defer client.Close()
+	response, err := client.Command("update", "podcasts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job, _ := response.get("updating_db"); job != "4" {
+		t.Fatalf("Unexpected update response %v", response)
+	}
+	if err = client.waitForUpdate(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMPDReplacePlaylist(t *testing.T) {
+	client := fakeMPD(t, []mpdExchange{
+		{`rm "new podcasts"`, "ACK [50@0] {rm} No such playlist\n"},
+		{`playlistadd "new podcasts" "show/1.mp3"`, "OK\n"},
+		{`playlistadd "new podcasts" "show/2.mp3"`, "ACK [50@0] {playlistadd} No such directory\n"},
+		{`playlistadd "new podcasts" "show/3.mp3"`, "OK\n"},
+	})
+	defer client.Close()
+	if err := client.replacePlaylist("new podcasts", []string{"show/1.mp3", "show/2.mp3", "show/3.mp3"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMPDCommandTimeout(t *testing.T) {
+	logger = NewLogger(false)
+	server, conn := net.Pipe()
+	defer server.Close()
+	go func() {
+		io.WriteString(server, "OK MPD 0.23.5\n")
+		bufio.NewReader(server).ReadString('\n')
+	}()
+	client, err := NewMPDClient(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.timeout = 50 * time.Millisecond
+	if _, err = client.Command("status"); err == nil {
+		t.Fatal("Expected a timeout from a hung MPD")
+	}
+	conn.Close()
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"mime"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/kennygrant/sanitize"
+)
+
+// MaxNameSize is the max size in bytes of a folder or file name given by the naming templates
+const MaxNameSize = 200
+
+// NamingData are the fields available to the folder and file naming templates,
+// the path separators of the feed values are replaced so that only the template makes sub folders
+type NamingData struct {
+	Podcast        string
+	Author         string
+	Category       string
+	Title          string
+	Date           string
+	Published      time.Time
+	Season         string
+	SeasonName     string
+	Number         string
+	EpisodeDisplay string
+	Hosts          string
+	EpisodeType    string
+	GUID           string
+	Name           string
+	Ext            string
+}
+
+// namingFunctions are the helper functions of the naming templates, added to the tag template ones
+var namingFunctions = template.FuncMap{
+	"pad": padNumber,
+}
+
+// padNumber left pads a number with zeros, an empty value stays empty
+func padNumber(width int, value string) string {
+	if value == "" {
+		return value
+	}
+	for len(value) < width {
+		value = "0" + value
+	}
+	return value
+}
+
+var separatorReplacer = strings.NewReplacer("/", "-", "\\", "-")
+
+// newPodcastNamingData gathers the podcast fields for the naming templates
+func newPodcastNamingData(podcast *Podcast) NamingData {
+	data := NamingData{
+		Podcast: separatorReplacer.Replace(podcast.feedPodcast.Title),
+		Author:  separatorReplacer.Replace(podcast.author()),
+	}
+	if categories := podcast.categories(); len(categories) > 0 {
+		data.Category = separatorReplacer.Replace(categories[0])
+	}
+	return data
+}
+
+// newNamingData gathers the episode and podcast fields for the naming templates
+func newNamingData(episode *Episode) NamingData {
+	data := newPodcastNamingData(episode.Podcast)
+	data.Title = separatorReplacer.Replace(episode.feedEpisode.Title)
+	data.EpisodeType = episode.episodeType()
+	data.GUID = separatorReplacer.Replace(episodeGUID(episode.feedEpisode))
+	if published, err := episode.feedEpisode.ParsedPubDate(); err == nil {
+		data.Published = published
+		data.Date = published.Format("2006-01-02")
+	}
+	season, number := episode.numbers()
+	if season > 0 {
+		data.Season = strconv.Itoa(season)
+	}
+	if number > 0 {
+		data.Number = strconv.Itoa(number)
+	}
+	data.SeasonName = separatorReplacer.Replace(episode.podcasting.SeasonName)
+	data.EpisodeDisplay = separatorReplacer.Replace(episode.podcasting.episodeNumber())
+	data.Hosts = separatorReplacer.Replace(strings.Join(personNames(episode.persons(), "host"), ", "))
+	resourceName := extractResourceNameFromURL(episode.enclosure.Url)
+	data.Ext = strings.TrimPrefix(filepath.Ext(resourceName), ".")
+	data.Name = strings.TrimSuffix(resourceName, filepath.Ext(resourceName))
+	if data.Ext == "" {
+		if extensions, err := mime.ExtensionsByType(episode.enclosure.Type); err == nil && len(extensions) > 0 {
+			data.Ext = strings.TrimPrefix(extensions[0], ".")
+		}
+	}
+	return data
+}
+
+// parseNamingTemplate parses a folder or file template, an empty or invalid template gives nil
+func parseNamingTemplate(name string, text string) *template.Template {
+	if text == "" {
+		return nil
+	}
+	return parseTemplate(name, text, tagTemplateFunctions, namingFunctions)
+}
+
+// renderName renders the parsed naming template into a relative path, each path element is cleaned up and the empty ones are dropped
+func renderName(parsed *template.Template, data NamingData) (string, error) {
+	var buffer bytes.Buffer
+	if err := parsed.Execute(&buffer, data); err != nil {
+		return "", err
+	}
+	var elements []string
+	for _, element := range strings.Split(buffer.String(), "/") {
+		if element = cleanName(element); element != "" {
+			elements = append(elements, element)
+		}
+	}
+	return filepath.Join(elements...), nil
+}
+
+// cleanName removes the characters forbidden in file names on the common file systems,
+// the name is cut to MaxNameSize bytes and keeps its extension
+func cleanName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsControl(r):
+			return -1
+		case strings.ContainsRune(`\:*?"<>|`, r):
+			return '_'
+		case unicode.IsSpace(r):
+			return ' '
+		}
+		return r
+	}, name)
+	name = strings.Trim(strings.Join(strings.Fields(name), " "), " .")
+	if len(name) <= MaxNameSize {
+		return name
+	}
+	extension := filepath.Ext(name)
+	if len(extension) > 10 {
+		extension = ""
+	}
+	base := name[:MaxNameSize-len(extension)]
+	for !utf8.ValidString(base) {
+		base = base[:len(base)-1]
+	}
+	return strings.TrimRight(base, " .") + extension
+}
+
+// folderName is the podcast folder name : the folder of the feed, the folderTemplate or the podcast title
+func (podcast Podcast) folderName() string {
+	if podcast.subscription.Folder != "" {
+		return podcast.subscription.Folder
+	}
+	if parsed := podcast.settings.FolderTemplate; parsed != nil {
+		name, err := renderName(parsed, newPodcastNamingData(&podcast))
+		if err == nil && name != "" {
+			return strings.Replace(name, string(filepath.Separator), " - ", -1)
+		}
+		logger.Warning.Println("Invalid folder template for "+podcast.feedPodcast.Title+", the podcast title is used", err)
+	}
+	return podcast.feedPodcast.Title
+}
+
+// legacyFile is the historical episode path : blp-<yymmdd>-<url name>
+func (e Episode) legacyFile() string {
+	fileNamePrefix := EpisodePrefix + e.pubDate() + "-"
+	return filepath.Join(e.Podcast.dir(), sanitize.Path(fileNamePrefix+extractResourceNameFromURL(e.enclosure.Url)))
+}
+
+// templateFile is the episode path given by the file template of the feed, a name already taken by another episode gets a number
+func (e Episode) templateFile() string {
+	path := e.legacyFile()
+	if parsed := e.Podcast.settings.FileTemplate; parsed != nil {
+		name, err := renderName(parsed, newNamingData(&e))
+		if err == nil && name != "" {
+			path = filepath.Join(e.Podcast.dir(), name)
+		} else {
+			logger.Warning.Println("Invalid file template for "+e.String()+", the default name is used", err)
+		}
+	}
+	return e.Podcast.names.reserve(path, &e)
+}
+
+// resolveFile is the recorded path of a downloaded episode when its file exists, the template path otherwise
+func (e Episode) resolveFile() string {
+	if record, found := states.lookup(&e); found && record.Path != "" && pathExists(record.Path) {
+		e.Podcast.names.reserve(record.Path, &e)
+		return record.Path
+	}
+	return e.templateFile()
+}
+
+// episodeNames are the episode paths of a podcast, a path belongs to the episode recorded with it or to the first episode named with it,
+// an existing file which is not recorded belongs to no episode, except the historical blp- files
+type episodeNames struct {
+	sync.Mutex
+	owners   map[string]string
+	recorded map[string]EpisodeRecord
+	// claimFiles gives the existing files to the episodes named with them, to rebuild the state database
+	claimFiles bool
+}
+
+func newEpisodeNames() *episodeNames {
+	return &episodeNames{owners: make(map[string]string)}
+}
+
+// reserve gives the path to the episode, or the first free numbered path (name (2).mp3) when it belongs to another episode
+func (names *episodeNames) reserve(path string, episode *Episode) string {
+	if names == nil {
+		return path
+	}
+	names.Lock()
+	defer names.Unlock()
+	if names.recorded == nil {
+		names.recorded = states.recordsByPath()
+	}
+	key := recordKey(episode.Podcast.subscription.URL, episodeGUID(episode.feedEpisode), episode.enclosure.Url)
+	extension := filepath.Ext(path)
+	candidate := path
+	for i := 2; ; i++ {
+		var free bool
+		if owner, reserved := names.owners[candidate]; reserved {
+			free = owner == key
+		} else if record, recorded := names.recorded[absolutePath(candidate)]; recorded {
+			free = record.Key == key || record.Enclosure == episode.enclosure.Url
+		} else {
+			free = names.claimFiles || candidate == episode.legacyFile() || !pathExists(candidate)
+		}
+		if free {
+			names.owners[candidate] = key
+			return candidate
+		}
+		candidate = strings.TrimSuffix(path, extension) + " (" + strconv.Itoa(i) + ")" + extension
+	}
+}
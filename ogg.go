@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// oggCRCTable is the lookup table of the Ogg page checksum (polynomial 0x04c11db7, without reflection)
+var oggCRCTable = func() (table [256]uint32) {
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// oggPage is an Ogg page, the packets are split by the lacing values of the segment table
+type oggPage struct {
+	headerType byte
+	granule    uint64
+	serial     uint32
+	sequence   uint32
+	segments   []byte
+	body       []byte
+}
+
+func readOggPage(r io.Reader) (*oggPage, error) {
+	header := make([]byte, 27)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if string(header[:4]) != "OggS" {
+		return nil, errors.New("Invalid Ogg page")
+	}
+	page := &oggPage{
+		headerType: header[5],
+		granule:    binary.LittleEndian.Uint64(header[6:]),
+		serial:     binary.LittleEndian.Uint32(header[14:]),
+		sequence:   binary.LittleEndian.Uint32(header[18:]),
+		segments:   make([]byte, header[26]),
+	}
+	if _, err := io.ReadFull(r, page.segments); err != nil {
+		return nil, err
+	}
+	size := 0
+	for _, lacing := range page.segments {
+		size += int(lacing)
+	}
+	page.body = make([]byte, size)
+	_, err := io.ReadFull(r, page.body)
+	return page, err
+}
+
+func (page *oggPage) encode() []byte {
+	encoded := make([]byte, 27, 27+len(page.segments)+len(page.body))
+	copy(encoded, "OggS")
+	encoded[5] = page.headerType
+	binary.LittleEndian.PutUint64(encoded[6:], page.granule)
+	binary.LittleEndian.PutUint32(encoded[14:], page.serial)
+	binary.LittleEndian.PutUint32(encoded[18:], page.sequence)
+	encoded[26] = byte(len(page.segments))
+	encoded = append(append(encoded, page.segments...), page.body...)
+	binary.LittleEndian.PutUint32(encoded[22:], oggChecksum(encoded))
+	return encoded
+}
+
+// oggChecksum is the CRC of an encoded page whose checksum field is zero
+func oggChecksum(data []byte) uint32 {
+	var crc uint32
+	for _, b := range data {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+func (page *oggPage) size() int64 {
+	return int64(27 + len(page.segments) + len(page.body))
+}
+
+// oggPages lays the header packets out into pages, the last packet ends the last page
+func oggPages(serial uint32, sequence uint32, packets [][]byte) []*oggPage {
+	var pages []*oggPage
+	page := &oggPage{serial: serial, sequence: sequence}
+	for _, packet := range packets {
+		for remaining := packet; ; {
+			if len(page.segments) == 255 {
+				pages = append(pages, page)
+				continued := page.segments[254] == 255
+				page = &oggPage{serial: serial, sequence: page.sequence + 1}
+				if continued {
+					page.headerType = 0x01
+				}
+			}
+			lacing := len(remaining)
+			if lacing > 255 {
+				lacing = 255
+			}
+			page.segments = append(page.segments, byte(lacing))
+			page.body = append(page.body, remaining[:lacing]...)
+			remaining = remaining[lacing:]
+			if lacing < 255 {
+				break
+			}
+		}
+	}
+	pages = append(pages, page)
+	for _, page := range pages {
+		page.granule = ^uint64(0)
+		for _, lacing := range page.segments {
+			if lacing < 255 {
+				page.granule = 0
+			}
+		}
+	}
+	return pages
+}
+
+// vorbisCommentFields are the Vorbis comment names of the episode tags
+var vorbisCommentFields = map[TagField]string{
+	TagTitle:   "TITLE",
+	TagArtist:  "ARTIST",
+	TagAlbum:   "ALBUM",
+	TagComment: "COMMENT",
+	TagGenre:   "GENRE",
+	TagTrack:   "TRACKNUMBER",
+	TagYear:    "DATE",
+
+	TagAlbumArtist: "ALBUMARTIST",
+	TagDisc:        "DISCNUMBER",
+	TagDescription: "DESCRIPTION",
+}
+
+// oggFile is an Ogg Vorbis or Opus file with its Vorbis comments
+type oggFile struct {
+	path        string
+	opus        bool
+	serial      uint32
+	sampleRate  int
+	preSkip     int
+	firstPage   *oggPage
+	vendor      string
+	comments    []string
+	extra       []byte
+	setup       []byte
+	headerPages uint32
+	headerEnd   int64
+}
+
+func openOggFile(path string) (*oggFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	f := &oggFile{path: path}
+	if f.firstPage, err = readOggPage(file); err != nil {
+		return nil, err
+	}
+	identification := f.firstPage.body
+	switch {
+	case bytes.HasPrefix(identification, []byte("\x01vorbis")) && len(identification) >= 16:
+		f.sampleRate = int(binary.LittleEndian.Uint32(identification[12:]))
+	case bytes.HasPrefix(identification, []byte("OpusHead")) && len(identification) >= 12:
+		f.opus = true
+		f.sampleRate = 48000
+		f.preSkip = int(binary.LittleEndian.Uint16(identification[10:]))
+	default:
+		return nil, errors.New("Unsupported Ogg codec : " + path)
+	}
+	f.serial = f.firstPage.serial
+	f.headerPages = 1
+	f.headerEnd = f.firstPage.size()
+	headerPackets := 2
+	if f.opus {
+		headerPackets = 1
+	}
+	var packets [][]byte
+	var packet []byte
+	for len(packets) < headerPackets {
+		page, err := readOggPage(file)
+		if err != nil {
+			return nil, err
+		}
+		if page.serial != f.serial {
+			return nil, errors.New("Unsupported multiplexed Ogg file : " + path)
+		}
+		f.headerPages++
+		f.headerEnd += page.size()
+		body := page.body
+		for _, lacing := range page.segments {
+			if len(packets) == headerPackets {
+				return nil, errors.New("Unsupported Ogg audio data in a header page : " + path)
+			}
+			packet = append(packet, body[:lacing]...)
+			body = body[lacing:]
+			if lacing < 255 {
+				packets = append(packets, packet)
+				packet = nil
+			}
+		}
+	}
+	if err = f.parseComments(packets[0]); err != nil {
+		return nil, err
+	}
+	if !f.opus {
+		f.setup = packets[1]
+	}
+	return f, nil
+}
+
+func (f *oggFile) commentsPrefix() string {
+	if f.opus {
+		return "OpusTags"
+	}
+	return "\x03vorbis"
+}
+
+func (f *oggFile) parseComments(packet []byte) error {
+	invalid := errors.New("Invalid Vorbis comments : " + f.path)
+	if !bytes.HasPrefix(packet, []byte(f.commentsPrefix())) {
+		return invalid
+	}
+	var extra []byte
+	var ok bool
+	if f.vendor, f.comments, extra, ok = parseVorbisComments(packet[len(f.commentsPrefix()):]); !ok {
+		return invalid
+	}
+	if f.opus {
+		f.extra = extra
+	}
+	return nil
+}
+
+// parseVorbisComments reads the vendor string and the comments, the data following them is returned as well
+func parseVorbisComments(data []byte) (vendor string, comments []string, extra []byte, ok bool) {
+	readString := func() (string, bool) {
+		if len(data) < 4 || uint64(binary.LittleEndian.Uint32(data)) > uint64(len(data)-4) {
+			return "", false
+		}
+		size := int(binary.LittleEndian.Uint32(data))
+		value := string(data[4 : 4+size])
+		data = data[4+size:]
+		return value, true
+	}
+	if vendor, ok = readString(); !ok || len(data) < 4 {
+		return "", nil, nil, false
+	}
+	count := int(binary.LittleEndian.Uint32(data))
+	data = data[4:]
+	for i := 0; i < count; i++ {
+		comment, ok := readString()
+		if !ok {
+			return "", nil, nil, false
+		}
+		comments = append(comments, comment)
+	}
+	return vendor, comments, data, true
+}
+
+func (f *oggFile) encodeComments() []byte {
+	packet := append([]byte(f.commentsPrefix()), encodeVorbisComments(f.vendor, f.comments)...)
+	if f.opus {
+		return append(packet, f.extra...)
+	}
+	return append(packet, 1)
+}
+
+func encodeVorbisComments(vendor string, comments []string) []byte {
+	var encoded []byte
+	number := make([]byte, 4)
+	appendString := func(value string) {
+		binary.LittleEndian.PutUint32(number, uint32(len(value)))
+		encoded = append(append(encoded, number...), value...)
+	}
+	appendString(vendor)
+	binary.LittleEndian.PutUint32(number, uint32(len(comments)))
+	encoded = append(encoded, number...)
+	for _, comment := range comments {
+		appendString(comment)
+	}
+	return encoded
+}
+
+func (f *oggFile) setTag(field TagField, value string) {
+	if name, found := vorbisCommentFields[field]; found {
+		f.setComment(name, value)
+	}
+}
+
+func (f *oggFile) setComment(name string, value string) {
+	f.comments = setVorbisComment(f.comments, name, value)
+}
+
+// setVorbisComment replaces the comments with the name, the new comment takes the place of the first one
+func setVorbisComment(comments []string, name string, value string) []string {
+	var updated []string
+	replaced := false
+	for _, comment := range comments {
+		if !strings.HasPrefix(strings.ToUpper(comment), name+"=") {
+			updated = append(updated, comment)
+		} else if !replaced {
+			updated = append(updated, name+"="+value)
+			replaced = true
+		}
+	}
+	if !replaced {
+		updated = append(updated, name+"="+value)
+	}
+	return updated
+}
+
+// setPicture replaces the METADATA_BLOCK_PICTURE comment with the artwork as a FLAC front cover picture block
+func (f *oggFile) setPicture(artwork *Artwork) {
+	f.setComment("METADATA_BLOCK_PICTURE", base64.StdEncoding.EncodeToString(flacPicture(artwork)))
+}
+
+// length is the duration given by the granule position of the last page
+func (f *oggFile) length() time.Duration {
+	file, err := os.Open(f.path)
+	if err != nil || f.sampleRate == 0 {
+		return 0
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0
+	}
+	offset := info.Size() - 64*1024
+	if offset < 0 {
+		offset = 0
+	}
+	data := make([]byte, info.Size()-offset)
+	if _, err = file.ReadAt(data, offset); err != nil {
+		return 0
+	}
+	for i := len(data) - 27; i >= 0; i-- {
+		if string(data[i:i+4]) == "OggS" && binary.LittleEndian.Uint32(data[i+14:]) == f.serial {
+			samples := int64(binary.LittleEndian.Uint64(data[i+6:])) - int64(f.preSkip)
+			if samples < 0 {
+				return 0
+			}
+			return time.Duration(samples * int64(time.Second) / int64(f.sampleRate))
+		}
+	}
+	return 0
+}
+
+// save rewrites the header pages with the comments, the sequence numbers of the audio pages are shifted when the header page count changes
+func (f *oggFile) save() error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	packets := [][]byte{f.encodeComments()}
+	if !f.opus {
+		packets = append(packets, f.setup)
+	}
+	pages := oggPages(f.serial, 1, packets)
+	// the unsigned shift wraps around when the header gets fewer pages
+	shift := uint32(len(pages)+1) - f.headerPages
+	if _, err = file.Seek(f.headerEnd, io.SeekStart); err != nil {
+		return err
+	}
+	err = writeFileAtomicWith(f.path, func(w io.Writer) error {
+		for _, page := range append([]*oggPage{f.firstPage}, pages...) {
+			if _, err := w.Write(page.encode()); err != nil {
+				return err
+			}
+		}
+		if shift == 0 {
+			_, err := io.Copy(w, file)
+			return err
+		}
+		for {
+			page, err := readOggPage(file)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if page.serial == f.serial {
+				page.sequence += shift
+			}
+			if _, err = w.Write(page.encode()); err != nil {
+				return err
+			}
+		}
+	})
+	if err == nil {
+		f.headerPages = uint32(len(pages) + 1)
+		f.headerEnd = f.firstPage.size()
+		for _, page := range pages {
+			f.headerEnd += page.size()
+		}
+	}
+	return err
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// oggPackets joins the packets laid out in the pages
+func oggPackets(pages []*oggPage) [][]byte {
+	var packets [][]byte
+	var packet []byte
+	for _, page := range pages {
+		body := page.body
+		for _, lacing := range page.segments {
+			packet = append(packet, body[:lacing]...)
+			body = body[lacing:]
+			if lacing < 255 {
+				packets = append(packets, packet)
+				packet = nil
+			}
+		}
+	}
+	return packets
+}
+
+// readOggFile reads all the pages of the file, each page must have a valid checksum
+func readOggFile(t *testing.T, path string) []*oggPage {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pages []*oggPage
+	for reader := bytes.NewReader(content); ; {
+		offset := len(content) - reader.Len()
+		page, err := readOggPage(reader)
+		if err == io.EOF {
+			return pages
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw := append([]byte{}, content[offset:offset+int(page.size())]...)
+		binary.LittleEndian.PutUint32(raw[22:], 0)
+		if checksum := binary.LittleEndian.Uint32(content[offset+22:]); checksum != oggChecksum(raw) {
+			t.Fatalf("Invalid checksum of the Ogg page %d", page.sequence)
+		}
+		pages = append(pages, page)
+	}
+}
+
+func TestOggChecksum(t *testing.T) {
+	// the CRC-32/CKSUM check value without its final inversion
+	if checksum := oggChecksum([]byte("123456789")); checksum != 0x89a1897f {
+		t.Fatalf("Unexpected Ogg checksum %x", checksum)
+	}
+}
+
+func TestOggPages(t *testing.T) {
+	tests := []struct {
+		name    string
+		packets [][]byte
+		pages   int
+	}{
+		{"small packets", [][]byte{make([]byte, 10), make([]byte, 255)}, 1},
+		{"full page ending a packet", [][]byte{make([]byte, 254*255), make([]byte, 10)}, 2},
+		{"packet across pages", [][]byte{make([]byte, 300*255+10), make([]byte, 10)}, 2},
+		{"packet ending at the page boundary", [][]byte{make([]byte, 255*255), make([]byte, 10)}, 2},
+	}
+	for _, test := range tests {
+		for i, packet := range test.packets {
+			for j := range packet {
+				packet[j] = byte(i + j)
+			}
+		}
+		pages := oggPages(7, 1, test.packets)
+		if len(pages) != test.pages {
+			t.Fatalf("%s : %d pages instead of %d", test.name, len(pages), test.pages)
+		}
+		for i, page := range pages {
+			if len(page.segments) > 255 || page.serial != 7 || page.sequence != uint32(1+i) {
+				t.Fatalf("%s : invalid page %d", test.name, i)
+			}
+			continued := i > 0 && pages[i-1].segments[len(pages[i-1].segments)-1] == 255
+			if continued != (page.headerType&0x01 != 0) {
+				t.Fatalf("%s : wrong continued flag on the page %d", test.name, i)
+			}
+			ended := false
+			for _, lacing := range page.segments {
+				ended = ended || lacing < 255
+			}
+			if ended != (page.granule == 0) || !ended && page.granule != ^uint64(0) {
+				t.Fatalf("%s : wrong granule position %x on the page %d", test.name, page.granule, i)
+			}
+		}
+		packets := oggPackets(pages)
+		if len(packets) != len(test.packets) {
+			t.Fatalf("%s : %d packets instead of %d", test.name, len(packets), len(test.packets))
+		}
+		for i := range packets {
+			if !bytes.Equal(packets[i], test.packets[i]) {
+				t.Fatalf("%s : packet %d changed", test.name, i)
+			}
+		}
+	}
+}
+
+// vorbisFixture encodes a small Ogg Vorbis file : its 3 header packets in 2 pages and 2 audio pages
+func vorbisFixture() (content []byte, audio []*oggPage) {
+	identification := make([]byte, 30)
+	copy(identification, "\x01vorbis")
+	binary.LittleEndian.PutUint32(identification[12:], 44100)
+	f := &oggFile{vendor: "fixture", comments: []string{"TITLE=Old title", "ARTIST=Someone"}}
+	setup := append([]byte("\x05vorbis"), make([]byte, 40)...)
+	pages := append([]*oggPage{{headerType: 0x02, serial: 5, segments: []byte{30}, body: identification}}, oggPages(5, 1, [][]byte{f.encodeComments(), setup})...)
+	audio = []*oggPage{
+		{granule: 44100, serial: 5, sequence: 2, segments: []byte{100}, body: bytes.Repeat([]byte{1}, 100)},
+		{headerType: 0x04, granule: 88200, serial: 5, sequence: 3, segments: []byte{50}, body: bytes.Repeat([]byte{2}, 50)},
+	}
+	for _, page := range append(pages, audio...) {
+		content = append(content, page.encode()...)
+	}
+	return content, audio
+}
+
+func TestOggRoundTrip(t *testing.T) {
+	logger = NewLogger(false)
+	content, audio := vorbisFixture()
+	path := writeFixture(t, "episode.ogg", content)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	// a comment larger than a page adds header pages, removing it removes them
+	for _, description := range []string{strings.Repeat("d", 100*1024), "short"} {
+		f, err := openOggFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.length().Seconds() != 2 {
+			t.Fatalf("Unexpected Ogg length %v", f.length())
+		}
+		f.setTag(TagTitle, "New title")
+		f.setTag(TagDescription, description)
+		if err = f.save(); err != nil {
+			t.Fatal(err)
+		}
+
+		pages := readOggFile(t, path)
+		for i, page := range pages {
+			if page.sequence != uint32(i) {
+				t.Fatalf("Ogg page %d has the sequence number %d", i, page.sequence)
+			}
+		}
+		saved := pages[len(pages)-len(audio):]
+		for i, page := range audio {
+			if !bytes.Equal(saved[i].body, page.body) || saved[i].granule != page.granule || saved[i].headerType != page.headerType {
+				t.Fatalf("Ogg audio page %d changed", i)
+			}
+		}
+		reopened, err := openOggFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{"TITLE=New title", "ARTIST=Someone", "DESCRIPTION=" + description}
+		if strings.Join(reopened.comments, "\n") != strings.Join(expected, "\n") || reopened.vendor != "fixture" {
+			t.Fatalf("Unexpected Vorbis comments %v", reopened.comments)
+		}
+		if len(reopened.setup) != 47 || reopened.headerPages != uint32(len(pages)-len(audio)) {
+			t.Fatalf("Ogg header pages badly written")
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+type opmlDocument struct {
+	XMLName xml.Name `xml:"opml"`
+	Version string   `xml:"version,attr"`
+	Head    opmlHead `xml:"head"`
+	Body    opmlBody `xml:"body"`
+}
+
+type opmlHead struct {
+	Title       string `xml:"title,omitempty"`
+	DateCreated string `xml:"dateCreated,omitempty"`
+}
+
+type opmlBody struct {
+	Outlines []opmlOutline `xml:"outline"`
+}
+
+type opmlOutline struct {
+	Text     string        `xml:"text,attr"`
+	Title    string        `xml:"title,attr,omitempty"`
+	Type     string        `xml:"type,attr,omitempty"`
+	XMLURL   string        `xml:"xmlUrl,attr,omitempty"`
+	HTMLURL  string        `xml:"htmlUrl,attr,omitempty"`
+	Category string        `xml:"category,attr,omitempty"`
+	Outlines []opmlOutline `xml:"outline"`
+}
+
+func newImportOPMLCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "import-opml <file>",
+		Short: "Import subscriptions from an OPML file",
+		Long:  `Add the feeds of an OPML file to the feeds file, feeds already subscribed are skipped`,
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := importOPML(args[0]); err != nil {
+				logger.Error.Fatalln("OPML import failure : ", err)
+			}
+		},
+	}
+}
+
+func newExportOPMLCmd() *cobra.Command {
+	var output string
+	cmd := &cobra.Command{
+		Use:   "export-opml",
+		Short: "Export subscriptions as an OPML file",
+		Long:  `Write the feeds file subscriptions as OPML 2.0 to the standard output or to a file`,
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := exportOPML(output); err != nil {
+				logger.Error.Fatalln("OPML export failure : ", err)
+			}
+		},
+	}
+	cmd.Flags().StringVarP(&output, "output", "o", "", "OPML file path (standard output by default)")
+	return cmd
+}
+
+func importOPML(opmlPath string) error {
+	imported, err := readOPML(opmlPath)
+	if err != nil {
+		return err
+	}
+	store, err := loadFeedsStore(feedsPath)
+	if err != nil {
+		return err
+	}
+
+	known := make(map[string]bool)
+	for _, subscription := range store.subscriptions() {
+		known[feedKey(subscription.URL)] = true
+	}
+
+	var added []Subscription
+	skipped := 0
+	for _, subscription := range imported {
+		if known[feedKey(subscription.URL)] {
+			logger.Debug.Println("Feed already subscribed : " + subscription.URL)
+			skipped++
+			continue
+		}
+		known[feedKey(subscription.URL)] = true
+		added = append(added, subscription)
+	}
+
+	if len(added) > 0 {
+		header := "Imported from " + opmlPath + " on " + time.Now().Format("2006-01-02")
+		store.add(header, added)
+		if err = store.save(); err != nil {
+			return err
+		}
+	}
+	for _, subscription := range added {
+		logger.Info.Println("Feed added : " + subscription.name() + " (" + subscription.URL + ")")
+	}
+	logger.Info.Println(strconv.Itoa(len(added)) + " feeds added to " + feedsPath + ", " + strconv.Itoa(skipped) + " already subscribed")
+	return nil
+}
+
+func readOPML(opmlPath string) ([]Subscription, error) {
+	file, err := os.Open(opmlPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var document opmlDocument
+	decoder := xml.NewDecoder(file)
+	decoder.CharsetReader = charsetReader
+	if err = decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+	return flattenOutlines(document.Body.Outlines, nil), nil
+}
+
+// flattenOutlines lists the feed outlines, the parent folder outlines are used as categories
+func flattenOutlines(outlines []opmlOutline, folders []string) []Subscription {
+	var subscriptions []Subscription
+	for _, outline := range outlines {
+		title := outline.Title
+		if title == "" {
+			title = outline.Text
+		}
+		if outline.XMLURL == "" {
+			children := folders
+			if title != "" {
+				children = append(append([]string{}, folders...), title)
+			}
+			subscriptions = append(subscriptions, flattenOutlines(outline.Outlines, children)...)
+			continue
+		}
+		subscription := Subscription{URL: strings.TrimSpace(outline.XMLURL), Title: title}
+		subscription.Categories = append(subscription.Categories, folders...)
+		for _, category := range strings.Split(outline.Category, ",") {
+			category = strings.Trim(strings.TrimSpace(category), "/")
+			if category != "" && !containsString(subscription.Categories, category) {
+				subscription.Categories = append(subscription.Categories, category)
+			}
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+	return subscriptions
+}
+
+func exportOPML(output string) error {
+	subscriptions, err := parseSubscriptions(feedsPath)
+	if err != nil {
+		return err
+	}
+
+	document := opmlDocument{
+		Version: "2.0",
+		Head: opmlHead{
+			Title:       "Blackpodder subscriptions",
+			DateCreated: time.Now().Format(time.RFC1123Z),
+		},
+	}
+	for _, subscription := range subscriptions {
+		if subscription.Disabled {
+			continue
+		}
+		var categories []string
+		for _, category := range subscription.Categories {
+			categories = append(categories, "/"+category)
+		}
+		document.Body.Outlines = append(document.Body.Outlines, opmlOutline{
+			Text:     subscription.name(),
+			Title:    subscription.Title,
+			Type:     "rss",
+			XMLURL:   subscription.URL,
+			Category: strings.Join(categories, ","),
+		})
+	}
+
+	var writer io.Writer = os.Stdout
+	if output != "" {
+		file, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		writer = file
+	}
+	content, err := xml.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(writer, xml.Header+string(content)+"\n")
+	return err
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Playlist file names, the extension is given by the playlist format
+const (
+	LastEpisodesPlaylist string = "last-episodes"
+	PodcastPlaylist      string = "podcast"
+)
+
+// PlaylistEntry is an episode of a playlist
+type PlaylistEntry struct {
+	Path     string
+	Podcast  string
+	Title    string
+	Duration int64
+}
+
+func (entry PlaylistEntry) name() string {
+	if entry.Podcast == "" {
+		return entry.Title
+	}
+	return entry.Podcast + " – " + entry.Title
+}
+
+// playlistFormats are the configured playlist formats (m3u8, xspf, pls)
+func playlistFormats() []string {
+	var formats []string
+	for _, value := range viper.GetStringSlice("playlistFormats") {
+		for _, format := range strings.Split(value, ",") {
+			format = strings.ToLower(strings.TrimSpace(format))
+			if format != "" && !containsString(formats, format) {
+				formats = append(formats, format)
+			}
+		}
+	}
+	return formats
+}
+
+// playlistEntries describes the episode files with the recorded episode states, the file name is used as title otherwise
+func playlistEntries(files []string) []PlaylistEntry {
+	recorded := states.recordsByPath()
+	var entries []PlaylistEntry
+	for _, file := range files {
+		entry := PlaylistEntry{Path: file, Podcast: filepath.Base(filepath.Dir(file)), Title: filepath.Base(file), Duration: -1}
+		if record, ok := recorded[absolutePath(file)]; ok {
+			entry.Podcast = record.Podcast
+			entry.Title = record.Title
+			if record.Duration > 0 {
+				entry.Duration = record.Duration
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// writePlaylists writes the playlist in each configured format, the path has no extension
+func writePlaylists(path string, entries []PlaylistEntry) {
+	for _, format := range playlistFormats() {
+		var content []byte
+		var err error
+		filename := path + "." + format
+		switch format {
+		case "m3u8":
+			content = m3u8Playlist(filename, entries)
+		case "pls":
+			content = plsPlaylist(filename, entries)
+		case "xspf":
+			content, err = xspfPlaylist(filename, entries)
+		default:
+			logger.Warning.Println("Unknown playlist format ignored : " + format)
+			continue
+		}
+		if err == nil {
+			err = writeFileAtomic(filename, content)
+		}
+		if err != nil {
+			logger.Error.Println("Cannot write the playlist "+filename, err)
+			continue
+		}
+		logger.Debug.Println("Playlist written : " + filename)
+	}
+}
+
+// writePodcastPlaylists writes the playlist of each podcast folder, the newest episodes first
+func writePodcastPlaylists() {
+	folders, err := ioutil.ReadDir(targetFolder)
+	if err != nil {
+		logger.Error.Println("Cannot list the podcast folders", err)
+		return
+	}
+	for _, folder := range folders {
+		if !folder.IsDir() || strings.HasPrefix(folder.Name(), ".") {
+			continue
+		}
+		podcastFolder := filepath.Join(targetFolder, folder.Name())
+		if files := listEpisodeFiles(podcastFolder); len(files) > 0 {
+			writePlaylists(filepath.Join(podcastFolder, PodcastPlaylist), playlistEntries(files))
+		}
+	}
+}
+
+// playlistPath is the episode path relative to the playlist folder
+func playlistPath(playlist string, path string) string {
+	relativePath, err := filepath.Rel(filepath.Dir(playlist), path)
+	if err != nil {
+		return path
+	}
+	return filepath.ToSlash(relativePath)
+}
+
+func m3u8Playlist(playlist string, entries []PlaylistEntry) []byte {
+	var content bytes.Buffer
+	content.WriteString("#EXTM3U\n")
+	for _, entry := range entries {
+		content.WriteString("#EXTINF:" + strconv.FormatInt(entry.Duration, 10) + "," + entry.name() + "\n")
+		content.WriteString(playlistPath(playlist, entry.Path) + "\n")
+	}
+	return content.Bytes()
+}
+
+func plsPlaylist(playlist string, entries []PlaylistEntry) []byte {
+	var content bytes.Buffer
+	content.WriteString("[playlist]\n")
+	for i, entry := range entries {
+		index := strconv.Itoa(i + 1)
+		content.WriteString("File" + index + "=" + playlistPath(playlist, entry.Path) + "\n")
+		content.WriteString("Title" + index + "=" + entry.name() + "\n")
+		content.WriteString("Length" + index + "=" + strconv.FormatInt(entry.Duration, 10) + "\n")
+	}
+	content.WriteString("NumberOfEntries=" + strconv.Itoa(len(entries)) + "\nVersion=2\n")
+	return content.Bytes()
+}
+
+type xspfTrack struct {
+	Location string `xml:"location"`
+	Creator  string `xml:"creator,omitempty"`
+	Title    string `xml:"title,omitempty"`
+	Duration int64  `xml:"duration,omitempty"`
+}
+
+type xspfDocument struct {
+	XMLName xml.Name    `xml:"http://xspf.org/ns/0/ playlist"`
+	Version string      `xml:"version,attr"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+func xspfPlaylist(playlist string, entries []PlaylistEntry) ([]byte, error) {
+	document := xspfDocument{Version: "1"}
+	for _, entry := range entries {
+		location := url.URL{Path: playlistPath(playlist, entry.Path)}
+		track := xspfTrack{Location: location.String(), Creator: entry.Podcast, Title: entry.Title}
+		if entry.Duration > 0 {
+			track.Duration = entry.Duration * 1000
+		}
+		document.Tracks = append(document.Tracks, track)
+	}
+	content, err := xml.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(content, '\n')...), nil
+}
@@ -2,13 +2,12 @@ package main
 
 import (
 	"image"
-	"io/ioutil"
+	"net/http"
 	"os"
 	"path/filepath"
-	"sort"
-	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	rss "github.com/jteeuwen/go-pkg-rss"
 	"github.com/kennygrant/sanitize"
@@ -16,13 +15,26 @@ import (
 
 // Podcast is a poscast
 type Podcast struct {
-	baseFolder  string
-	feedPodcast *rss.Channel
-	wg          *sync.WaitGroup
+	baseFolder   string
+	feedPodcast  *rss.Channel
+	wg           *sync.WaitGroup
+	subscription *Subscription
+	settings     FeedSettings
+	client       *http.Client
+	podcasting   PodcastingChannel
+	folder       string
+	names        *episodeNames
+	failures     *int32
 }
 
 func (podcast Podcast) dir() (path string) {
-	podcastFolder := filepath.Join(podcast.baseFolder, podcast.feedPodcast.Title)
+	if podcast.folder != "" {
+		return podcast.folder
+	}
+	podcastFolder := filepath.Join(podcast.baseFolder, podcast.folderName())
+	if podcast.subscription.Folder == "" && podcast.settings.FolderTemplate != nil {
+		return podcastFolder
+	}
 	podcastFolder = sanitize.Path(podcastFolder)
 	return podcastFolder
 }
@@ -32,7 +44,7 @@ func (podcast Podcast) mkdir() error {
 }
 
 func (podcast Podcast) image() string {
-	imageName := extractResourceNameFromURL(podcast.feedPodcast.Image.Url)
+	imageName := extractResourceNameFromURL(podcast.imageURL())
 	imageName = sanitize.Path(imageName)
 
 	return filepath.Join(podcast.dir(), imageName)
@@ -44,11 +56,11 @@ func (podcast Podcast) convertedImage() string {
 
 func (podcast Podcast) downloadImage() {
 	var err error
-	if len(podcast.feedPodcast.Image.Url) > 0 {
+	if len(podcast.imageURL()) > 0 {
 		if !pathExists(podcast.image()) {
 			logger.Info.Println("Cover available for podcast : " + podcast.feedPodcast.Title)
-			logger.Debug.Println("Downloading image : " + podcast.feedPodcast.Image.Url)
-			_, _, err := downloadFromURL(podcast.feedPodcast.Image.Url, podcast.dir(), maxRetryDownload, httpClient, filepath.Base(podcast.image()))
+			logger.Debug.Println("Downloading image : " + podcast.imageURL())
+			_, _, err := downloadFromURL(podcast.imageURL(), podcast.dir(), maxRetryDownload, podcast.client, filepath.Base(podcast.image()), nil)
 			if err == nil {
 				err = podcast.convertImage()
 				if err != nil {
@@ -87,93 +99,143 @@ func (podcast Podcast) convertImage() error {
 	return err
 }
 
-//NewPodcast makes a new podcast
-func NewPodcast(baseFolder string, feedPodcast *rss.Channel) *Podcast {
+//NewPodcast makes a new podcast with the feed subscription settings
+func NewPodcast(baseFolder string, feedPodcast *rss.Channel, subscription *Subscription) *Podcast {
 	var wg sync.WaitGroup
 	p := new(Podcast)
 	p.baseFolder = baseFolder
 	p.feedPodcast = feedPodcast
 	p.wg = &wg
+	p.subscription = subscription
+	p.settings = subscription.settings()
+	if subscription.Serial == nil {
+		p.settings.Serial = isSerialChannel(feedPodcast)
+	}
+	p.client = subscription.client()
+	p.podcasting = NewPodcastingChannel(feedPodcast)
+	p.folder = p.dir()
+	p.names = newEpisodeNames()
+	p.failures = new(int32)
 	return p
 }
 
-func (podcast Podcast) fetchNewEpisodes(newitems []*rss.Item) {
+// fetchNewEpisodes downloads the new episodes of the feed, it tells if all of them were processed without failure
+func (podcast Podcast) fetchNewEpisodes(newitems []*rss.Item) bool {
 	podcast.mkdir()
 	podcast.downloadImage()
 
+	if newFeedURL := podcast.newFeedURL(); newFeedURL != "" && feedKey(newFeedURL) != feedKey(podcast.subscription.URL) {
+		logger.Warning.Println("The podcast " + podcast.feedPodcast.Title + " has moved to " + newFeedURL + ", please update the feeds file")
+	}
+	if podcast.complete() {
+		logger.Debug.Println("No more episodes will be published for " + podcast.feedPodcast.Title)
+	}
+
+	if podcast.settings.Archive {
+		podcast.fetchArchive(newitems)
+		return podcast.processed()
+	}
+	if podcast.settings.Serial {
+		podcast.fetchSerial(newitems)
+		return podcast.processed()
+	}
+
 	episodeCounter := 0
 
 	for _, item := range newitems {
+		if isStopping() {
+			logger.Debug.Println("Stop requested, the remaining episodes are skipped : " + podcast.feedPodcast.Title)
+			break
+		}
 		episode := NewEpisode(item, &podcast)
 		selectedEnclosure := episode.enclosure
 		if selectedEnclosure != nil {
-			if len(episode.feedEpisode.Enclosures) > 0 {
-				episodeCounter++
+			if reason := podcast.settings.Filter.skipReason(episode); reason != "" {
+				logger.Debug.Println("Episode skipped : " + episode.String() + " (" + reason + ")")
+				continue
+			}
+			episodeCounter++
+			states.record(episode, StatusSeen, "")
+			if states.isKnown(episode) && !podcast.settings.RetagExisting {
+				logger.Debug.Println("Episode already downloaded : " + episode.String())
+			} else {
 				podcast.wg.Add(1)
 				episodeTasks <- episode
-				if episodeCounter >= maxEpisodes {
-					break
-				}
+			}
+			if podcast.settings.Episodes > 0 && episodeCounter >= podcast.settings.Episodes {
+				break
 			}
 		} else {
-			logger.Debug.Println("No audio found for episode " + podcast.feedPodcast.Title + " - " + item.Title)
+			logger.Debug.Println("No enclosure selected for episode " + podcast.feedPodcast.Title + " - " + item.Title)
 		}
 	}
 	logger.Debug.Println("Wait for all episodes to be processed : " + podcast.feedPodcast.Title)
 	podcast.wg.Wait()
 	podcast.removeOldEpisodes()
+	return podcast.processed()
+}
+
+// processed tells if the episodes were processed without download failure, a stop request may have skipped some of them
+func (podcast Podcast) processed() bool {
+	return atomic.LoadInt32(podcast.failures) == 0 && !isStopping()
 }
 
 func process(episode *Episode) {
 	defer episode.Podcast.wg.Done()
 	selectedEnclosure := episode.enclosure
-	if !pathExists(episode.file()) {
+	if pathExists(episode.file()) {
+		if !states.isKnown(episode) {
+			states.record(episode, StatusDownloaded, episode.file())
+		}
+	} else if !states.isKnown(episode) {
 		logger.Info.Println("New episode available : " + episode.Podcast.feedPodcast.Title + " | " + episode.feedEpisode.Title)
-		file, newEpisode, err := downloadFromURL(selectedEnclosure.Url, episode.Podcast.dir(), maxRetryDownload, httpClient, filepath.Base(episode.file()))
+		var expected *ExpectedResource
+		if validateDownloads {
+			expected = &ExpectedResource{Type: selectedEnclosure.Type, Length: selectedEnclosure.Length}
+		}
+		if err := os.MkdirAll(filepath.Dir(episode.file()), 0777); err != nil {
+			logger.Error.Println("Cannot create the episode folder : "+filepath.Dir(episode.file()), err)
+			atomic.AddInt32(episode.Podcast.failures, 1)
+			return
+		}
+		file, newEpisode, err := downloadFromURL(selectedEnclosure.Url, filepath.Dir(episode.file()), maxRetryDownload, episode.Podcast.client, filepath.Base(episode.file()), expected)
 		if err != nil {
 			logger.Error.Println("Episode download failure : "+selectedEnclosure.Url, err)
+			if _, rejected := err.(*DownloadValidationError); rejected {
+				states.record(episode, StatusQuarantined, "")
+			} else {
+				states.record(episode, StatusFailed, "")
+				atomic.AddInt32(episode.Podcast.failures, 1)
+			}
 		} else {
+			states.record(episode, StatusDownloaded, file)
 			if newEpisode {
 				logger.Info.Println("New episode downloaded : " + episode.Podcast.feedPodcast.Title + " | " + episode.feedEpisode.Title)
-				if strings.Contains(episode.enclosure.Type, "ogg") {
-					logger.Warning.Println("Fixing tag has been disabled for ogg (file corruption)")
-
-				} else {
-					completeTags(episode)
-				}
+				completeTags(episode)
 				newEpisodes <- file
 			}
 		}
 	}
-	if retagExisting {
+	if episode.Podcast.settings.RetagExisting {
 		completeTags(episode)
 	}
 }
 
-//removeOldEpisodes remove old podcast epipsode files
-func (podcast Podcast) removeOldEpisodes() {
-	if keptEpisodes > 0 {
-		var episodeFiles []os.FileInfo
-		files, _ := ioutil.ReadDir(podcast.dir())
-		for _, f := range files {
-			if strings.HasPrefix(f.Name(), EpisodePrefix) {
-				episodeFiles = append(episodeFiles, f)
-			}
-		}
-		sort.Sort(ByModDate(episodeFiles))
-		for i, f := range episodeFiles {
-			if i >= keptEpisodes {
-				filePath := filepath.Join(podcast.dir(), f.Name())
-				logger.Info.Println("Remove old episode : " + filePath + " (Keep only " + strconv.Itoa(keptEpisodes) + " episodes)")
-				os.Remove(filePath)
-			}
+//removeFeedOldEpisodes applies the retention policy of a feed whose items were not handled,
+//its podcast folder is the one of its recorded episodes
+func removeFeedOldEpisodes(subscription *Subscription) {
+	recorded := states.recordsByPath()
+	for path, record := range recorded {
+		if record.Status == StatusDownloaded && feedKey(record.Feed) == feedKey(subscription.URL) {
+			files := podcastFiles(libraryFolder(path), recorded)
+			removeEpisodes(subscription.settings().retention().removals(files, time.Now()), false)
+			return
 		}
 	}
 }
 
-//ByModDate sorts by modification date
-type ByModDate []os.FileInfo
-
-func (a ByModDate) Len() int           { return len(a) }
-func (a ByModDate) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a ByModDate) Less(i, j int) bool { return a[i].ModTime().Unix() > a[j].ModTime().Unix() }
+//removeOldEpisodes removes the podcast episode files beyond the retention policy of the feed
+func (podcast Podcast) removeOldEpisodes() {
+	files := podcastFiles(podcast.dir(), states.recordsByPath())
+	removeEpisodes(podcast.settings.retention().removals(files, time.Now()), false)
+}
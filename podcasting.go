@@ -0,0 +1,157 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	rss "github.com/jteeuwen/go-pkg-rss"
+)
+
+// PodcastingChapters is the podcast:chapters link of an episode
+type PodcastingChapters struct {
+	URL  string
+	Type string
+}
+
+// PodcastingTranscript is a podcast:transcript link of an episode
+type PodcastingTranscript struct {
+	URL      string
+	Type     string
+	Language string
+	Rel      string
+}
+
+// PodcastingPerson is a podcast:person of a podcast or an episode
+type PodcastingPerson struct {
+	Name  string
+	Role  string
+	Group string
+	Image string
+	Href  string
+}
+
+// PodcastingFunding is a podcast:funding link of a podcast
+type PodcastingFunding struct {
+	URL  string
+	Text string
+}
+
+// PodcastingEpisode is the Podcasting 2.0 data of an episode
+type PodcastingEpisode struct {
+	Chapters       *PodcastingChapters
+	Transcripts    []PodcastingTranscript
+	Persons        []PodcastingPerson
+	Season         int
+	SeasonName     string
+	Episode        float64
+	EpisodeDisplay string
+}
+
+// PodcastingChannel is the Podcasting 2.0 data of a podcast
+type PodcastingChannel struct {
+	GUID        string
+	Locked      bool
+	LockedOwner string
+	Funding     []PodcastingFunding
+	Persons     []PodcastingPerson
+}
+
+func podcastingValues(extensions map[string]map[string][]rss.Extension, name string) []rss.Extension {
+	return extensions[PodcastNamespace][name]
+}
+
+func podcastingPersons(extensions map[string]map[string][]rss.Extension) []PodcastingPerson {
+	var persons []PodcastingPerson
+	for _, person := range podcastingValues(extensions, "person") {
+		persons = append(persons, PodcastingPerson{
+			Name:  strings.TrimSpace(person.Value),
+			Role:  strings.ToLower(person.Attrs["role"]),
+			Group: strings.ToLower(person.Attrs["group"]),
+			Image: person.Attrs["img"],
+			Href:  person.Attrs["href"],
+		})
+	}
+	return persons
+}
+
+// NewPodcastingEpisode reads the podcast namespace elements of the feed item
+func NewPodcastingEpisode(item *rss.Item) PodcastingEpisode {
+	var episode PodcastingEpisode
+	if chapters := podcastingValues(item.Extensions, "chapters"); len(chapters) > 0 && chapters[0].Attrs["url"] != "" {
+		episode.Chapters = &PodcastingChapters{URL: chapters[0].Attrs["url"], Type: chapters[0].Attrs["type"]}
+	}
+	for _, transcript := range podcastingValues(item.Extensions, "transcript") {
+		if transcript.Attrs["url"] == "" {
+			continue
+		}
+		episode.Transcripts = append(episode.Transcripts, PodcastingTranscript{
+			URL:      transcript.Attrs["url"],
+			Type:     transcript.Attrs["type"],
+			Language: transcript.Attrs["language"],
+			Rel:      transcript.Attrs["rel"],
+		})
+	}
+	episode.Persons = podcastingPersons(item.Extensions)
+	if seasons := podcastingValues(item.Extensions, "season"); len(seasons) > 0 {
+		episode.Season, _ = strconv.Atoi(strings.TrimSpace(seasons[0].Value))
+		episode.SeasonName = seasons[0].Attrs["name"]
+	}
+	if episodes := podcastingValues(item.Extensions, "episode"); len(episodes) > 0 {
+		episode.Episode, _ = strconv.ParseFloat(strings.TrimSpace(episodes[0].Value), 64)
+		episode.EpisodeDisplay = episodes[0].Attrs["display"]
+	}
+	return episode
+}
+
+// NewPodcastingChannel reads the podcast namespace elements of the feed channel
+func NewPodcastingChannel(ch *rss.Channel) PodcastingChannel {
+	var channel PodcastingChannel
+	if guids := podcastingValues(ch.Extensions, "guid"); len(guids) > 0 {
+		channel.GUID = strings.TrimSpace(guids[0].Value)
+	}
+	if locked := podcastingValues(ch.Extensions, "locked"); len(locked) > 0 {
+		channel.Locked = strings.EqualFold(strings.TrimSpace(locked[0].Value), "yes")
+		channel.LockedOwner = locked[0].Attrs["owner"]
+	}
+	for _, funding := range podcastingValues(ch.Extensions, "funding") {
+		if funding.Attrs["url"] != "" {
+			channel.Funding = append(channel.Funding, PodcastingFunding{URL: funding.Attrs["url"], Text: strings.TrimSpace(funding.Value)})
+		}
+	}
+	channel.Persons = podcastingPersons(ch.Extensions)
+	return channel
+}
+
+// episodeNumber is the episode number to display, the podcast:episode display text first
+func (e PodcastingEpisode) episodeNumber() string {
+	if e.EpisodeDisplay != "" {
+		return e.EpisodeDisplay
+	}
+	if e.Episode > 0 {
+		return strconv.FormatFloat(e.Episode, 'f', -1, 64)
+	}
+	return ""
+}
+
+// personNames lists the names of the persons with the given role, all the persons when the role is empty
+func personNames(persons []PodcastingPerson, role string) []string {
+	var names []string
+	for _, person := range persons {
+		personRole := person.Role
+		if personRole == "" {
+			personRole = "host"
+		}
+		if role == "" || personRole == role {
+			names = append(names, person.Name)
+		}
+	}
+	return names
+}
+
+// persons are the persons of the episode, the podcast ones when the episode has none
+func (e Episode) persons() []PodcastingPerson {
+	if len(e.podcasting.Persons) > 0 {
+		return e.podcasting.Persons
+	}
+	return e.Podcast.podcasting.Persons
+}
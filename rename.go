@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	rss "github.com/jteeuwen/go-pkg-rss"
+	"github.com/spf13/cobra"
+)
+
+func newRenameCmd() *cobra.Command {
+	var dryRun bool
+	cmd := &cobra.Command{
+		Use:   "rename",
+		Short: "Move the library to the naming templates",
+		Long: `Move the downloaded episodes, with their sidecar files, to the paths given by the current folderTemplate and fileTemplate settings.
+The episode states and the playlists are updated, the feeds are read from the feed cache when possible.
+The episode files missing from the state database are not moved (see state rebuild).`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			exitOnError("Cannot rename the library", renameLibrary(dryRun))
+		},
+	}
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Only print the episodes to be moved")
+	return cmd
+}
+
+func renameLibrary(dryRun bool) error {
+	var err error
+	states, err = OpenStateStore(stateDatabasePath())
+	if err != nil {
+		return err
+	}
+	defer states.Close()
+
+	subscriptions, err := parseSubscriptions(feedsPath)
+	if err != nil {
+		return err
+	}
+	warnUnrecordedFiles()
+	moves := make(map[string]string)
+	for i := range subscriptions {
+		subscription := &subscriptions[i]
+		channel, err := cachedChannel(subscription)
+		if err != nil {
+			logger.Warning.Println("Feed parsing failure with "+subscription.URL, err)
+			continue
+		}
+		podcast := NewPodcast(targetFolder, channel, subscription)
+		oldFolders := make(map[string]bool)
+		for _, item := range channel.Items {
+			episode := NewEpisode(item, podcast)
+			if episode.enclosure == nil {
+				continue
+			}
+			record, found := states.lookup(episode)
+			if !found || record.Path == "" || !pathExists(record.Path) {
+				continue
+			}
+			target := episode.templateFile()
+			if absolutePath(target) == absolutePath(record.Path) {
+				continue
+			}
+			if dryRun {
+				if pathExists(target) {
+					logger.Error.Println("Cannot rename the episode "+record.Path, errors.New("The file already exists : "+target))
+				} else {
+					logger.Info.Println("Would rename " + record.Path + " to " + target)
+				}
+				continue
+			}
+			if err = renameEpisode(record, target); err != nil {
+				logger.Error.Println("Cannot rename the episode "+record.Path, err)
+				continue
+			}
+			logger.Info.Println("Episode renamed : " + record.Path + " -> " + target)
+			moves[record.Path] = target
+			oldFolders[libraryFolder(record.Path)] = true
+		}
+		for folder := range oldFolders {
+			if absolutePath(folder) != absolutePath(podcast.dir()) {
+				movePodcastFolder(folder, podcast.dir())
+			}
+		}
+	}
+	if dryRun {
+		return nil
+	}
+	for from := range moves {
+		removeEmptyParents(filepath.Dir(from))
+	}
+	renamePlaylistEntries(moves)
+	writePodcastPlaylists()
+	updateMPD(nil)
+	logger.Info.Println(strconv.Itoa(len(moves)) + " episodes renamed")
+	return nil
+}
+
+// warnUnrecordedFiles lists the episode files of the library which are not recorded in the state database
+func warnUnrecordedFiles() {
+	recorded := states.recordsByPath()
+	for _, folder := range podcastFolders() {
+		for _, file := range podcastFiles(folder, recorded) {
+			if _, found := recorded[absolutePath(file.Path)]; !found {
+				logger.Warning.Println("Episode file not recorded, it is not renamed (see state rebuild) : " + file.Path)
+			}
+		}
+	}
+}
+
+// cachedChannel parses the cached feed content, the feed is fetched when it is not cached
+func cachedChannel(subscription *Subscription) (*rss.Channel, error) {
+	content, err := ioutil.ReadFile(feedCachePath(subscription.URL) + ".xml")
+	if err != nil {
+		return probeFeed(subscription)
+	}
+	feed := rss.New(5, true, chanHandler, func(*rss.Feed, *rss.Channel, []*rss.Item) {})
+	if err = feed.FetchBytes(subscription.URL, content, charsetReader); err != nil {
+		return nil, err
+	}
+	if len(feed.Channels) == 0 {
+		return nil, errors.New("No channel found in the feed " + subscription.URL)
+	}
+	channel := feed.Channels[0]
+	completeChannelTitle(feed, channel)
+	return channel, nil
+}
+
+// renameEpisode moves the recorded episode file and its sidecar files, the target file is never overwritten
+func renameEpisode(record EpisodeRecord, target string) error {
+	if pathExists(target) {
+		return errors.New("The file already exists : " + target)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+		return err
+	}
+	if err := os.Rename(record.Path, target); err != nil {
+		return err
+	}
+	if err := moveSidecars(record.Path, target); err != nil {
+		return err
+	}
+	record.Path = target
+	return states.put(record)
+}
+
+// libraryFolder is the podcast folder of a library file : its first folder in the library
+func libraryFolder(path string) string {
+	relativePath, err := filepath.Rel(absolutePath(targetFolder), absolutePath(path))
+	if err != nil {
+		return filepath.Dir(path)
+	}
+	return filepath.Join(targetFolder, strings.Split(relativePath, string(filepath.Separator))[0])
+}
+
+// movePodcastFolder moves the podcast images left in the previous podcast folder, its playlists are removed since they are written again
+func movePodcastFolder(from string, to string) {
+	for path := range states.recordsByPath() {
+		if strings.HasPrefix(path, absolutePath(from)+string(filepath.Separator)) && pathExists(path) {
+			logger.Debug.Println("Episodes left in " + from + ", its other files are not moved")
+			return
+		}
+	}
+	files, _ := ioutil.ReadDir(from)
+	for _, f := range files {
+		if !f.Mode().IsRegular() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(from, f.Name())
+		if strings.TrimSuffix(f.Name(), filepath.Ext(f.Name())) == PodcastPlaylist {
+			os.Remove(path)
+		} else if target := filepath.Join(to, f.Name()); !pathExists(target) {
+			if err := os.Rename(path, target); err != nil {
+				logger.Warning.Println("Cannot move "+path, err)
+			}
+		}
+	}
+	removeEmptyParents(from)
+}
+
+// removeEmptyParents removes the folder and its parent folders while they are empty, the library folder is kept
+func removeEmptyParents(folder string) {
+	for absolutePath(folder) != absolutePath(targetFolder) && strings.HasPrefix(absolutePath(folder), absolutePath(targetFolder)) {
+		removeEmptyFolders(folder)
+		if content, err := ioutil.ReadDir(folder); err != nil || len(content) > 0 || os.Remove(folder) != nil {
+			return
+		}
+		folder = filepath.Dir(folder)
+	}
+}
+
+// renamePlaylistEntries replaces the moved episode paths in the last episodes playlists
+func renamePlaylistEntries(moves map[string]string) {
+	if len(moves) == 0 {
+		return
+	}
+	for _, format := range playlistFormats() {
+		playlist := filepath.Join(targetFolder, LastEpisodesPlaylist) + "." + format
+		content, err := ioutil.ReadFile(playlist)
+		if err != nil {
+			continue
+		}
+		var replacements []string
+		for from, to := range moves {
+			if location := playlistLocation(format, playlist, from); location != "" {
+				replacements = append(replacements, location, playlistLocation(format, playlist, to))
+			}
+		}
+		if len(replacements) == 0 {
+			continue
+		}
+		if err = writeFileAtomic(playlist, []byte(strings.NewReplacer(replacements...).Replace(string(content)))); err != nil {
+			logger.Error.Println("Cannot write the playlist "+playlist, err)
+		}
+	}
+}
+
+// playlistLocation is the episode location as written in the playlist format, with its delimiters
+func playlistLocation(format string, playlist string, path string) string {
+	switch format {
+	case "m3u8":
+		return "\n" + playlistPath(playlist, path) + "\n"
+	case "pls":
+		return "=" + playlistPath(playlist, path) + "\n"
+	case "xspf":
+		location := url.URL{Path: playlistPath(playlist, path)}
+		var escaped bytes.Buffer
+		xml.EscapeText(&escaped, []byte(location.String()))
+		return "<location>" + escaped.String() + "</location>"
+	}
+	return ""
+}
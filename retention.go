@@ -0,0 +1,261 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/kennygrant/sanitize"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// RetentionPolicy tells which episodes of a podcast are kept, a zero value disables the rule
+type RetentionPolicy struct {
+	KeptEpisodes int
+	KeepAge      time.Duration
+	MaxSize      uint64
+}
+
+// LibraryFile is an episode file of the library
+type LibraryFile struct {
+	Path      string
+	Size      int64
+	Published time.Time
+	Kept      bool
+}
+
+// Removal is a library file to be removed with the reason of the removal
+type Removal struct {
+	File   LibraryFile
+	Reason string
+}
+
+// retention is the retention policy of the feed, the archived feeds are never cleaned up
+// and the serial feeds episodes only leave the library once played
+func (settings FeedSettings) retention() RetentionPolicy {
+	if settings.Archive || settings.Serial {
+		return RetentionPolicy{}
+	}
+	return RetentionPolicy{KeptEpisodes: settings.KeptEpisodes, KeepAge: settings.KeepAge, MaxSize: settings.MaxSize}
+}
+
+// sizeLimited tells if the feed episodes may be removed by the library size limit, never for the archived and serial feeds
+func (settings FeedSettings) sizeLimited() bool {
+	return !settings.Archive && !settings.Serial
+}
+
+// removals applies the policy to the podcast files, the newest episodes are kept first
+func (policy RetentionPolicy) removals(files []LibraryFile, now time.Time) []Removal {
+	sortNewestFirst(files)
+	var removals []Removal
+	var size uint64
+	for i, file := range files {
+		reason := ""
+		switch {
+		case policy.KeptEpisodes > 0 && i >= policy.KeptEpisodes:
+			reason = "keep only " + strconv.Itoa(policy.KeptEpisodes) + " episodes"
+		case policy.KeepAge > 0 && now.Sub(file.Published) > policy.KeepAge:
+			reason = "published more than " + policy.KeepAge.String() + " ago"
+		case policy.MaxSize > 0 && size+uint64(file.Size) > policy.MaxSize:
+			reason = "podcast size limited to " + bytefmt.ByteSize(policy.MaxSize)
+		}
+		if reason != "" && !file.Kept {
+			removals = append(removals, Removal{File: file, Reason: reason})
+			continue
+		}
+		size += uint64(file.Size)
+	}
+	return removals
+}
+
+// librarySizeRemovals removes the oldest episodes of the whole library beyond the maximum size
+func librarySizeRemovals(files []LibraryFile, maxSize uint64) []Removal {
+	var removals []Removal
+	if maxSize == 0 {
+		return removals
+	}
+	sortNewestFirst(files)
+	var size uint64
+	for _, file := range files {
+		if !file.Kept && size+uint64(file.Size) > maxSize {
+			removals = append(removals, Removal{File: file, Reason: "library size limited to " + bytefmt.ByteSize(maxSize)})
+			continue
+		}
+		size += uint64(file.Size)
+	}
+	return removals
+}
+
+func sortNewestFirst(files []LibraryFile) {
+	sort.SliceStable(files, func(i, j int) bool { return files[i].Published.After(files[j].Published) })
+}
+
+// podcastFiles lists the episode files of the podcast folder and its sub folders, the publication date is the recorded one,
+// then the one of the file name, then the file modification date
+//
+// An episode file is named with the blp- prefix, or recorded in the state database when named by a file template.
+func podcastFiles(folder string, recorded map[string]EpisodeRecord) []LibraryFile {
+	var libraryFiles []LibraryFile
+	filepath.Walk(folder, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if f.IsDir() {
+			if path != folder && strings.HasPrefix(f.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		record, isRecorded := recorded[absolutePath(path)]
+		if !(strings.HasPrefix(f.Name(), EpisodePrefix) || isRecorded) || isPartialDownload(f.Name()) || isSidecarFile(f.Name()) || !f.Mode().IsRegular() {
+			return nil
+		}
+		file := LibraryFile{Path: path, Size: f.Size(), Published: f.ModTime()}
+		if fileDate, err := time.Parse("060102", strings.SplitN(strings.TrimPrefix(f.Name(), EpisodePrefix), "-", 2)[0]); err == nil {
+			file.Published = fileDate
+		}
+		if isRecorded {
+			file.Kept = record.Kept
+			if !record.PublishedAt.IsZero() {
+				file.Published = record.PublishedAt
+			}
+		}
+		libraryFiles = append(libraryFiles, file)
+		return nil
+	})
+	return libraryFiles
+}
+
+// removeEpisodes moves the episode files to the trash, they are only listed in dry run mode
+func removeEpisodes(removals []Removal, dryRun bool) {
+	for _, removal := range removals {
+		if dryRun {
+			logger.Info.Println("Would remove " + removal.File.Path + " (" + removal.Reason + ")")
+			continue
+		}
+		logger.Info.Println("Remove old episode : " + removal.File.Path + " (" + removal.Reason + ")")
+		if err := moveToTrash(removal.File.Path, removal.Reason); err != nil {
+			logger.Error.Println("Cannot remove the episode "+removal.File.Path, err)
+			continue
+		}
+		states.markRemoved(removal.File.Path)
+	}
+}
+
+// removeLibraryOverflow applies the library size limit to the podcast folders, except the archived and serial ones
+func removeLibraryOverflow(dryRun bool) {
+	maxSize := parseByteSize(viper.GetString("maxLibrarySize"))
+	if maxSize == 0 {
+		return
+	}
+	subscriptions, err := parseSubscriptions(feedsPath)
+	if err != nil {
+		logger.Error.Println("Cannot apply the library size limit", err)
+		return
+	}
+	recorded := states.recordsByPath()
+	var files []LibraryFile
+	for _, folder := range podcastFolders() {
+		if folderSubscription(folder, subscriptions, recorded).settings().sizeLimited() {
+			files = append(files, podcastFiles(folder, recorded)...)
+		}
+	}
+	removeEpisodes(librarySizeRemovals(files, maxSize), dryRun)
+}
+
+// podcastFolders lists the podcast folders of the library
+func podcastFolders() []string {
+	var folders []string
+	files, err := ioutil.ReadDir(targetFolder)
+	if err != nil {
+		logger.Error.Println("Cannot list the podcast folders", err)
+		return folders
+	}
+	for _, f := range files {
+		if f.IsDir() && !strings.HasPrefix(f.Name(), ".") {
+			folders = append(folders, filepath.Join(targetFolder, f.Name()))
+		}
+	}
+	return folders
+}
+
+func newCleanCmd() *cobra.Command {
+	var dryRun bool
+	cmd := &cobra.Command{
+		Use:   "clean",
+		Short: "Apply the retention policies to the library",
+		Long: `Remove the episodes beyond the retention policies of their feed (keptEpisodes, keepAge, maxSize)
+and of the library (maxLibrarySize), without fetching the feeds. The episodes marked as kept are never removed,
+the archived and serial feeds episodes are not removed by the library size limit.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			exitOnError("Cannot clean the library", cleanLibrary(dryRun))
+		},
+	}
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Only print the episodes to be removed and why")
+	return cmd
+}
+
+func cleanLibrary(dryRun bool) error {
+	var err error
+	states, err = OpenStateStore(stateDatabasePath())
+	if err != nil {
+		return err
+	}
+	defer states.Close()
+
+	subscriptions, err := parseSubscriptions(feedsPath)
+	if err != nil {
+		return err
+	}
+	recorded := states.recordsByPath()
+	var remainingFiles []LibraryFile
+	for _, folder := range podcastFolders() {
+		settings := folderSubscription(folder, subscriptions, recorded).settings()
+		files := podcastFiles(folder, recorded)
+		removals := settings.retention().removals(files, time.Now())
+		removeEpisodes(removals, dryRun)
+		if !settings.sizeLimited() {
+			continue
+		}
+		removed := make(map[string]bool)
+		for _, removal := range removals {
+			removed[removal.File.Path] = true
+		}
+		for _, file := range files {
+			if !removed[file.Path] {
+				remainingFiles = append(remainingFiles, file)
+			}
+		}
+	}
+	removeEpisodes(librarySizeRemovals(remainingFiles, parseByteSize(viper.GetString("maxLibrarySize"))), dryRun)
+	return nil
+}
+
+// folderSubscription finds the subscription of a podcast folder, by its configured folder or by the recorded episodes,
+// an empty subscription with the global settings is returned otherwise
+func folderSubscription(folder string, subscriptions []Subscription, recorded map[string]EpisodeRecord) Subscription {
+	folder = absolutePath(folder)
+	for _, subscription := range subscriptions {
+		if subscription.Folder != "" && absolutePath(sanitize.Path(filepath.Join(targetFolder, subscription.Folder))) == folder {
+			return subscription
+		}
+	}
+	for path, record := range recorded {
+		if !strings.HasPrefix(path, folder+string(filepath.Separator)) {
+			continue
+		}
+		for _, subscription := range subscriptions {
+			if feedKey(subscription.URL) == feedKey(record.Feed) {
+				return subscription
+			}
+		}
+	}
+	return Subscription{}
+}
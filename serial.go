@@ -0,0 +1,111 @@
+package main
+
+import (
+	"strings"
+
+	rss "github.com/jteeuwen/go-pkg-rss"
+)
+
+// isSerialChannel tells if the podcast episodes are meant to be listened in order (itunes:type serial)
+func isSerialChannel(ch *rss.Channel) bool {
+	values := ch.Extensions[ItunesNamespace]["type"]
+	return len(values) > 0 && strings.EqualFold(strings.TrimSpace(values[0].Value), "serial")
+}
+
+// replaysUnchangedFeed tells if the feed items have to be handled at each run, even when the feed has not changed
+func (s Subscription) replaysUnchangedFeed() bool {
+	settings := s.settings()
+	return settings.Archive || settings.Serial
+}
+
+// serialOrder sorts the numbered feed items by season and episode number (itunes or podcast namespace) first,
+// then by publication date and by reversed feed order
+func serialOrder(items []*rss.Item) []*rss.Item {
+	return sortItems(itemKeys(items), itemKey.serialBefore)
+}
+
+// serialBefore orders the numbered items before the other ones by season and episode number, then the items by publication date
+func (key itemKey) serialBefore(other itemKey) bool {
+	numbered, otherNumbered := key.episode > 0, other.episode > 0
+	if numbered != otherNumbered {
+		return numbered
+	}
+	if numbered && key.season != other.season {
+		return key.season < other.season
+	}
+	if numbered && key.episode != other.episode {
+		return key.episode < other.episode
+	}
+	return key.olderThan(other)
+}
+
+// fetchSerial keeps the next unplayed episodes of a serial podcast in order, from the first episode not played yet.
+// An episode whose file has been deleted is marked as played, so that the next one is downloaded.
+func (podcast Podcast) fetchSerial(items []*rss.Item) {
+	window := 0
+	for _, item := range serialOrder(items) {
+		if isStopping() {
+			logger.Debug.Println("Stop requested, the remaining episodes are skipped : " + podcast.feedPodcast.Title)
+			break
+		}
+		if podcast.settings.SerialWindow > 0 && window >= podcast.settings.SerialWindow {
+			break
+		}
+		episode := NewEpisode(item, &podcast)
+		if episode.enclosure == nil {
+			logger.Debug.Println("No enclosure selected for episode " + podcast.feedPodcast.Title + " - " + item.Title)
+			continue
+		}
+		if reason := podcast.settings.Filter.skipReason(episode); reason != "" {
+			logger.Debug.Println("Episode skipped : " + episode.String() + " (" + reason + ")")
+			continue
+		}
+		states.record(episode, StatusSeen, "")
+		record, found := states.lookup(episode)
+		if found && (record.Status == StatusPlayed || record.Status == StatusRemoved || record.rejected(episode)) {
+			continue
+		}
+		if found && record.Status == StatusDownloaded && !pathExists(episode.file()) {
+			logger.Info.Println("Episode deleted, marked as played : " + episode.String())
+			states.record(episode, StatusPlayed, "")
+			continue
+		}
+		window++
+		if found && record.Status == StatusDownloaded && !podcast.settings.RetagExisting {
+			logger.Debug.Println("Unplayed episode : " + episode.String())
+			continue
+		}
+		podcast.wg.Add(1)
+		episodeTasks <- episode
+	}
+	logger.Debug.Println("Wait for all serial episodes to be processed : " + podcast.feedPodcast.Title)
+	podcast.wg.Wait()
+}
+
+// markPlayed marks the episode files as played and moves them to the trash
+func markPlayed(files []string) error {
+	var err error
+	states, err = OpenStateStore(stateDatabasePath())
+	if err != nil {
+		return err
+	}
+	defer states.Close()
+
+	for _, file := range files {
+		record, err := states.pathRecord(file)
+		if err != nil {
+			return err
+		}
+		if pathExists(file) {
+			if err = moveToTrash(file, "played"); err != nil {
+				return err
+			}
+		}
+		record.Status = StatusPlayed
+		if err = states.put(record); err != nil {
+			return err
+		}
+		logger.Info.Println("Episode played : " + record.Podcast + " | " + record.Title)
+	}
+	return nil
+}
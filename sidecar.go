@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sidecarSuffixes are the suffixes of the files written next to an episode file
+var sidecarSuffixes = []string{ChaptersSuffix, CueSuffix, SubRipSuffix, LyricsSuffix}
+
+// sidecarPath is the path of the sidecar file of the episode file with the given suffix
+func sidecarPath(path string, suffix string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + suffix
+}
+
+// sidecarFiles lists the existing sidecar files of the episode file
+func sidecarFiles(path string) []string {
+	var files []string
+	for _, suffix := range sidecarSuffixes {
+		if sidecar := sidecarPath(path, suffix); pathExists(sidecar) {
+			files = append(files, sidecar)
+		}
+	}
+	return files
+}
+
+// moveSidecars moves the sidecar files of the episode file along with it
+func moveSidecars(from string, to string) error {
+	for _, suffix := range sidecarSuffixes {
+		if sidecar := sidecarPath(from, suffix); pathExists(sidecar) {
+			if err := os.Rename(sidecar, sidecarPath(to, suffix)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isSidecarFile tells if the file name is the one of an episode sidecar file
+func isSidecarFile(name string) bool {
+	for _, suffix := range sidecarSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
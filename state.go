@@ -0,0 +1,429 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	rss "github.com/jteeuwen/go-pkg-rss"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Episode states recorded in the state database
+const (
+	StatusSeen        = "seen"
+	StatusDownloaded  = "downloaded"
+	StatusFailed      = "failed"
+	StatusQuarantined = "quarantined"
+	StatusRemoved     = "removed"
+	StatusPlayed      = "played"
+)
+
+var (
+	episodesBucket   = []byte("episodes")
+	enclosuresBucket = []byte("enclosures")
+	archivesBucket   = []byte("archives")
+)
+
+// EpisodeRecord is the state of a feed item, keyed by its feed and its GUID (or enclosure url when there is no GUID)
+type EpisodeRecord struct {
+	Key          string    `json:"key"`
+	Feed         string    `json:"feed"`
+	GUID         string    `json:"guid,omitempty"`
+	Enclosure    string    `json:"enclosure"`
+	Podcast      string    `json:"podcast"`
+	Title        string    `json:"title"`
+	Status       string    `json:"status"`
+	Path         string    `json:"path,omitempty"`
+	Size         int64     `json:"size,omitempty"`
+	Duration     int64     `json:"duration,omitempty"`
+	PublishedAt  time.Time `json:"publishedAt,omitempty"`
+	Kept         bool      `json:"kept,omitempty"`
+	SeenAt       time.Time `json:"seenAt"`
+	DownloadedAt time.Time `json:"downloadedAt,omitempty"`
+}
+
+// StateStore is the persistent episode state database
+type StateStore struct {
+	db *bolt.DB
+}
+
+var states *StateStore
+
+func stateDatabasePath() string {
+	if path := viper.GetString("stateDatabase"); path != "" {
+		return path
+	}
+	return filepath.Join(targetFolder, ".blackpodder.db")
+}
+
+// OpenStateStore opens the state database, it is created if needed
+func OpenStateStore(path string) (*StateStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{episodesBucket, enclosuresBucket, archivesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &StateStore{db: db}, nil
+}
+
+// Close closes the state database
+func (s *StateStore) Close() error {
+	if s == nil {
+		return nil
+	}
+	return s.db.Close()
+}
+
+func episodeGUID(item *rss.Item) string {
+	if item.Guid != nil && strings.TrimSpace(*item.Guid) != "" {
+		return strings.TrimSpace(*item.Guid)
+	}
+	return strings.TrimSpace(item.Id)
+}
+
+func recordKey(feed string, guid string, enclosure string) string {
+	if guid == "" {
+		guid = enclosure
+	}
+	return feedKey(feed) + "\n" + guid
+}
+
+// lookup finds the episode record by GUID first, then by enclosure url
+func (s *StateStore) lookup(episode *Episode) (record EpisodeRecord, found bool) {
+	if s == nil || episode.enclosure == nil {
+		return record, false
+	}
+	s.db.View(func(tx *bolt.Tx) error {
+		episodes := tx.Bucket(episodesBucket)
+		value := episodes.Get([]byte(recordKey(episode.Podcast.subscription.URL, episodeGUID(episode.feedEpisode), episode.enclosure.Url)))
+		if value == nil {
+			if key := tx.Bucket(enclosuresBucket).Get([]byte(episode.enclosure.Url)); key != nil {
+				value = episodes.Get(key)
+			}
+		}
+		if value != nil {
+			found = json.Unmarshal(value, &record) == nil
+		}
+		return nil
+	})
+	return record, found
+}
+
+// isKnown tells if the episode has already been downloaded, even if its file has been removed since,
+// or if its download has been rejected (see state retry)
+func (s *StateStore) isKnown(episode *Episode) bool {
+	record, found := s.lookup(episode)
+	return found && (record.Status == StatusDownloaded || record.Status == StatusRemoved || record.Status == StatusPlayed || record.rejected(episode))
+}
+
+// rejected tells if the record is a quarantined download of the episode enclosure, a changed enclosure is downloaded again
+func (record EpisodeRecord) rejected(episode *Episode) bool {
+	return record.Status == StatusQuarantined && record.Enclosure == episode.enclosure.Url
+}
+
+func (s *StateStore) put(record EpisodeRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(episodesBucket).Put([]byte(record.Key), value); err != nil {
+			return err
+		}
+		return tx.Bucket(enclosuresBucket).Put([]byte(record.Enclosure), []byte(record.Key))
+	})
+}
+
+// record updates the episode state, the existing record is updated when the episode is already known
+func (s *StateStore) record(episode *Episode, status string, path string) {
+	if s == nil || episode.enclosure == nil {
+		return
+	}
+	record, found := s.lookup(episode)
+	if !found {
+		record = EpisodeRecord{
+			Key:    recordKey(episode.Podcast.subscription.URL, episodeGUID(episode.feedEpisode), episode.enclosure.Url),
+			SeenAt: time.Now(),
+		}
+	} else if status == StatusSeen {
+		return
+	}
+	record.Feed = episode.Podcast.subscription.URL
+	record.GUID = episodeGUID(episode.feedEpisode)
+	record.Enclosure = episode.enclosure.Url
+	record.Podcast = episode.Podcast.feedPodcast.Title
+	record.Title = episode.feedEpisode.Title
+	record.Status = status
+	record.Duration = int64(episode.duration().Seconds())
+	if published, err := episode.feedEpisode.ParsedPubDate(); err == nil {
+		record.PublishedAt = published
+	}
+	if path != "" {
+		record.Path = path
+		if info, err := os.Stat(path); err == nil {
+			record.Size = info.Size()
+			if status == StatusDownloaded && record.DownloadedAt.IsZero() {
+				record.DownloadedAt = info.ModTime()
+			}
+		}
+	}
+	if status == StatusDownloaded && record.DownloadedAt.IsZero() {
+		record.DownloadedAt = time.Now()
+	}
+	if err := s.put(record); err != nil {
+		logger.Warning.Println("Cannot record the episode state : "+episode.String(), err)
+	}
+}
+
+// markRemoved records that the episode file has been removed from the library
+func (s *StateStore) markRemoved(path string) {
+	if s == nil {
+		return
+	}
+	for _, record := range s.records() {
+		if absolutePath(record.Path) == absolutePath(path) && record.Status == StatusDownloaded {
+			record.Status = StatusRemoved
+			if err := s.put(record); err != nil {
+				logger.Warning.Println("Cannot record the episode state : "+path, err)
+			}
+		}
+	}
+}
+
+// markRestored records that the removed or played episode file is back in the library
+func (s *StateStore) markRestored(path string) {
+	if s == nil {
+		return
+	}
+	for _, record := range s.records() {
+		if absolutePath(record.Path) == absolutePath(path) && (record.Status == StatusRemoved || record.Status == StatusPlayed) {
+			record.Status = StatusDownloaded
+			if err := s.put(record); err != nil {
+				logger.Warning.Println("Cannot record the episode state : "+path, err)
+			}
+		}
+	}
+}
+
+// recordsByPath indexes the records of the library files by absolute path
+func (s *StateStore) recordsByPath() map[string]EpisodeRecord {
+	indexed := make(map[string]EpisodeRecord)
+	if s == nil {
+		return indexed
+	}
+	for _, record := range s.records() {
+		if record.Path != "" {
+			indexed[absolutePath(record.Path)] = record
+		}
+	}
+	return indexed
+}
+
+// setKept marks the episode file as kept, a kept episode is never removed by the retention policies
+func (s *StateStore) setKept(path string, kept bool) error {
+	record, err := s.pathRecord(path)
+	if err != nil {
+		return err
+	}
+	record.Kept = kept
+	return s.put(record)
+}
+
+func (s *StateStore) pathRecord(path string) (EpisodeRecord, error) {
+	record, found := s.recordsByPath()[absolutePath(path)]
+	if !found {
+		return record, errors.New("No recorded episode for " + path + " (see state rebuild)")
+	}
+	return record, nil
+}
+
+func (s *StateStore) records() []EpisodeRecord {
+	var records []EpisodeRecord
+	s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(episodesBucket).ForEach(func(key []byte, value []byte) error {
+			var record EpisodeRecord
+			if json.Unmarshal(value, &record) == nil {
+				records = append(records, record)
+			}
+			return nil
+		})
+	})
+	return records
+}
+
+func newStateCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "state",
+		Short: "Manage the episode state database",
+	}
+	cmd.AddCommand(
+		&cobra.Command{
+			Use:   "rebuild",
+			Short: "Record the episodes found in the library",
+			Long:  `Fetch the feeds and record the episodes whose file is found in the library as downloaded`,
+			Args:  cobra.NoArgs,
+			Run: func(cmd *cobra.Command, args []string) {
+				exitOnError("Cannot rebuild the state database", rebuildStates())
+			},
+		},
+		&cobra.Command{
+			Use:   "keep <file>...",
+			Short: "Never remove the episodes",
+			Long:  `Mark the episode files as kept : the retention policies never remove them`,
+			Args:  cobra.MinimumNArgs(1),
+			Run: func(cmd *cobra.Command, args []string) {
+				exitOnError("Cannot keep the episodes", keepEpisodes(args, true))
+			},
+		},
+		&cobra.Command{
+			Use:   "unkeep <file>...",
+			Short: "Let the retention policies remove the episodes",
+			Args:  cobra.MinimumNArgs(1),
+			Run: func(cmd *cobra.Command, args []string) {
+				exitOnError("Cannot unkeep the episodes", keepEpisodes(args, false))
+			},
+		},
+		&cobra.Command{
+			Use:   "played <file>...",
+			Short: "Mark episodes as played",
+			Long: `Mark the episodes as played and move them to the trash, the next episodes of the serial podcasts are downloaded at the next run.
+A serial podcast episode whose file has been deleted is marked as played as well.`,
+			Args: cobra.MinimumNArgs(1),
+			Run: func(cmd *cobra.Command, args []string) {
+				exitOnError("Cannot mark the episodes as played", markPlayed(args))
+			},
+		},
+		&cobra.Command{
+			Use:   "retry [podcast]",
+			Short: "Download the rejected episodes again",
+			Long:  `Forget the quarantined downloads of all the podcasts, or of the podcast : they are downloaded again at the next run`,
+			Args:  cobra.MaximumNArgs(1),
+			Run: func(cmd *cobra.Command, args []string) {
+				exitOnError("Cannot retry the quarantined episodes", retryQuarantined(args))
+			},
+		},
+		&cobra.Command{
+			Use:   "list [podcast]",
+			Short: "List the recorded episodes",
+			Long:  `List the recorded episodes as tab separated lines : status, podcast, episode title, download date, size and path`,
+			Args:  cobra.MaximumNArgs(1),
+			Run: func(cmd *cobra.Command, args []string) {
+				exitOnError("Cannot list the episode states", listStates(args))
+			},
+		},
+	)
+	return cmd
+}
+
+func rebuildStates() error {
+	store, err := OpenStateStore(stateDatabasePath())
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	subscriptions, err := parseSubscriptions(feedsPath)
+	if err != nil {
+		return err
+	}
+	recorded := 0
+	for i := range subscriptions {
+		subscription := &subscriptions[i]
+		channel, err := probeFeed(subscription)
+		if err != nil {
+			logger.Warning.Println("Feed parsing failure with "+subscription.URL, err)
+			continue
+		}
+		podcast := NewPodcast(targetFolder, channel, subscription)
+		podcast.names.claimFiles = true
+		for _, item := range channel.Items {
+			episode := NewEpisode(item, podcast)
+			if episode.enclosure == nil {
+				continue
+			}
+			if pathExists(episode.file()) {
+				store.record(episode, StatusDownloaded, episode.file())
+				recorded++
+			} else {
+				store.record(episode, StatusSeen, "")
+			}
+		}
+	}
+	logger.Info.Println(strconv.Itoa(recorded) + " downloaded episodes recorded in " + stateDatabasePath())
+	return nil
+}
+
+func keepEpisodes(files []string, kept bool) error {
+	store, err := OpenStateStore(stateDatabasePath())
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	for _, file := range files {
+		if err = store.setKept(file, kept); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func retryQuarantined(args []string) error {
+	store, err := OpenStateStore(stateDatabasePath())
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	retried := 0
+	for _, record := range store.records() {
+		if record.Status != StatusQuarantined || len(args) > 0 && !strings.EqualFold(record.Podcast, args[0]) {
+			continue
+		}
+		record.Status = StatusSeen
+		if err = store.put(record); err != nil {
+			return err
+		}
+		retried++
+	}
+	logger.Info.Println(strconv.Itoa(retried) + " quarantined episodes will be downloaded again")
+	return nil
+}
+
+func listStates(args []string) error {
+	store, err := OpenStateStore(stateDatabasePath())
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	for _, record := range store.records() {
+		if len(args) > 0 && !strings.EqualFold(record.Podcast, args[0]) {
+			continue
+		}
+		downloadedAt := ""
+		if !record.DownloadedAt.IsZero() {
+			downloadedAt = record.DownloadedAt.Format(time.RFC3339)
+		}
+		logger.Info.Println(strings.Join([]string{record.Status, record.Podcast, record.Title, downloadedAt, strconv.FormatInt(record.Size, 10), record.Path}, "\t"))
+	}
+	return nil
+}
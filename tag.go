@@ -1,65 +1,84 @@
 package main
 
 import (
-	"os/exec"
 	"strconv"
-	"sync"
+	"strings"
 
 	"fmt"
 
-	"github.com/jaytaylor/html2text"
-	"github.com/wtolson/go-taglib"
+	"github.com/spf13/viper"
 )
 
 //EpisodeTag is a podcast episode tag
 type EpisodeTag struct {
 }
 
-var execWg sync.WaitGroup
-
 func completeTags(episode *Episode) {
 
 	logger.Debug.Println("Tag update : " + episode.Podcast.feedPodcast.Title + " - " + episode.feedEpisode.Title + " : " + episode.file())
 
-	tag, err := taglib.Read(episode.file())
+	tag, err := openTagFile(episode.file())
 	if err != nil {
 		logger.Warning.Println("Cannot complete episode tags for "+episode.Podcast.feedPodcast.Title+" - "+episode.feedEpisode.Title, err)
+		writeChapters(episode, nil, 0)
+		writeTranscript(episode, nil, 0)
 		return
 	}
-	defer tag.Close()
+	length := tag.length()
 
-	var replaceArtist string
-	if episode.feedEpisode.Author.Name != "" {
-		replaceArtist = episode.feedEpisode.Author.Name
-	} else {
-		replaceArtist = episode.Podcast.feedPodcast.Title
+	data := newTagData(episode)
+	for _, field := range templateTagFields {
+		parsed := episode.Podcast.settings.TagTemplates[field]
+		if parsed == nil {
+			continue
+		}
+		value, err := renderTagTemplate(parsed, data)
+		if err != nil {
+			logger.Warning.Println("Invalid "+string(field)+" tag template for "+episode.Podcast.feedPodcast.Title, err)
+			continue
+		}
+		if value != "" {
+			completeTag(field, value, tag)
+		}
 	}
+	completeTag(TagPodcast, "1", tag)
+	completeTag(TagFeedURL, episode.Podcast.subscription.URL, tag)
 
-	//use the podcast title for now
-	replaceArtist = episode.Podcast.feedPodcast.Title
-
-	completeTag(taglib.Artist, replaceArtist, tag)
-	completeTag(taglib.Album, episode.Podcast.feedPodcast.Title, tag)
-
-	plaintextDescription, err := html2text.FromString(episode.feedEpisode.Description)
-	if err == nil {
-		episode.feedEpisode.Description = plaintextDescription
+	if guid := episodeGUID(episode.feedEpisode); guid != "" {
+		completeTag(TagEpisodeID, guid, tag)
 	}
-	if len(episode.feedEpisode.Description) > maxCommentSize+5 {
-		episode.feedEpisode.Description = episode.feedEpisode.Description[:maxCommentSize] + " ..."
+	if categories := episode.Podcast.categories(); len(categories) > 0 {
+		completeTag(TagCategory, strings.Join(categories, ", "), tag)
+	}
+	if keywords := episode.keywords(); keywords != "" {
+		completeTag(TagKeywords, keywords, tag)
 	}
 
-	completeTag(taglib.Comments, episode.feedEpisode.Description, tag)
-	completeTag(taglib.Title, episode.feedEpisode.Title+" "+episode.formattedPubDate(dateFormat), tag)
-	completeTag(taglib.Genre, "Podcast", tag)
+	season, number := episode.numbers()
+	if number > 0 {
+		completeTag(TagTrack, strconv.Itoa(number), tag)
+	}
+	if season > 0 {
+		completeTag(TagDisc, strconv.Itoa(season), tag)
+	}
 
 	pubdate, err := episode.feedEpisode.ParsedPubDate()
 	if err == nil {
-		completeTag(taglib.Year, strconv.Itoa(pubdate.Year()), tag)
+		completeTag(TagYear, strconv.Itoa(pubdate.Year()), tag)
+		completeTag(TagReleaseDate, pubdate.UTC().Format("2006-01-02T15:04:05"), tag)
+	}
+	if viper.GetBool("embedArtwork") {
+		artwork, err := episodeArtwork(episode)
+		if err == nil {
+			tag.setPicture(artwork)
+		} else {
+			logger.Warning.Println("Cannot embed the artwork of "+episode.Podcast.feedPodcast.Title+" - "+episode.feedEpisode.Title, err)
+		}
 	}
+	writeChapters(episode, tag, length)
+	writeTranscript(episode, tag, length)
 	logger.Debug.Println("Tag Write Start for : " + episode.file())
-	err = tag.Save()
-	//setAlbumArtist(episode.Podcast.feedPodcast.Title, episode.file())
+	err = tag.save()
 
 	logger.Debug.Println("Tag Write End for : " + episode.file())
 	if err != nil {
@@ -68,20 +87,7 @@ func completeTags(episode *Episode) {
 	logger.Debug.Println("Tag update END : " + episode.Podcast.feedPodcast.Title + " - " + episode.feedEpisode.Title)
 
 }
-func completeTag(tagname taglib.TagName, tagvalue string, tag *taglib.File) {
-	logger.Debug.Println(fmt.Sprintf("Tag: %s --> %s", tagname.String(), tagvalue))
-	tag.SetTag(tagname, tagvalue)
-}
-
-func setAlbumArtist(albumartist string, filepath string) {
-	cmd := exec.Command("eyeD3", "--text-frame=TPE2:"+albumartist, filepath)
-	logger.Debug.Println("Command to be executed : ", cmd.Args)
-	err := cmd.Run()
-	if err != nil {
-		cmd := exec.Command("eyeD3", "--set-text-frame=TPE2:"+albumartist, filepath)
-		err = cmd.Run()
-		if err != nil {
-			logger.Error.Println("Cannot set albumartist tag : ", err)
-		}
-	}
+func completeTag(tagname TagField, tagvalue string, tag tagFile) {
+	logger.Debug.Println(fmt.Sprintf("Tag: %s --> %s", tagname, tagvalue))
+	tag.setTag(tagname, tagvalue)
 }
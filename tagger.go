@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TagField is an episode tag, each tag format maps it to its own frame, comment or atom
+type TagField string
+
+// Episode tags written by completeTags
+const (
+	TagTitle   TagField = "title"
+	TagArtist  TagField = "artist"
+	TagAlbum   TagField = "album"
+	TagComment TagField = "comment"
+	TagGenre   TagField = "genre"
+	TagTrack   TagField = "track"
+	TagYear    TagField = "year"
+
+	TagAlbumArtist TagField = "albumArtist"
+	TagDisc        TagField = "disc"
+	TagPodcast     TagField = "podcast"
+	TagFeedURL     TagField = "feedURL"
+	TagEpisodeID   TagField = "episodeID"
+	TagDescription TagField = "description"
+	TagCategory    TagField = "category"
+	TagKeywords    TagField = "keywords"
+	TagReleaseDate TagField = "releaseDate"
+)
+
+// tagFile is an episode file whose tags can be completed, the tags are only written by save
+type tagFile interface {
+	setTag(field TagField, value string)
+	setPicture(artwork *Artwork)
+	length() time.Duration
+	save() error
+}
+
+// openTagFile reads the tags of the episode file : ID3v2 for mp3 and aac, Vorbis comments for Ogg Vorbis, Opus and FLAC, atoms for mp4
+func openTagFile(path string) (tagFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 12)
+	n, err := io.ReadFull(file, header)
+	file.Close()
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	format := sniffFormat(header[:n])
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	}
+	switch format {
+	case "id3", "mp3", "aac":
+		return openID3File(path)
+	case "ogg", "oga", "opus":
+		return openOggFile(path)
+	case "mp4", "m4a", "m4b":
+		return openMP4File(path)
+	case "flac":
+		return openFLACFile(path)
+	}
+	return nil, errors.New("Unsupported tag format : " + path)
+}
+
+// parseTrackNumber reads a track or disc number written as 3 or 3/10
+func parseTrackNumber(value string) (int, error) {
+	return strconv.Atoi(strings.TrimSpace(strings.SplitN(value, "/", 2)[0]))
+}
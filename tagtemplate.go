@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jaytaylor/html2text"
+	rss "github.com/jteeuwen/go-pkg-rss"
+	"github.com/spf13/viper"
+)
+
+// templateTagFields are the tags whose values are rendered from the tag templates, in writing order
+var templateTagFields = []TagField{TagArtist, TagAlbum, TagAlbumArtist, TagTitle, TagGenre, TagComment, TagDescription}
+
+// defaultTagTemplates are the default tag templates, the episode title is followed by its publication date
+var defaultTagTemplates = map[TagField]string{
+	TagTitle:       "{{.Title}} {{.PubDate}}",
+	TagArtist:      "{{.Podcast.Title}}",
+	TagAlbum:       "{{.Podcast.Title}}",
+	TagAlbumArtist: "{{.Podcast.Title}}",
+	TagGenre:       "Podcast",
+	TagComment:     "{{.Description | text | truncate .MaxCommentSize}}",
+	TagDescription: "{{.Description | text}}",
+}
+
+// TagPodcastData are the podcast fields available to the tag templates
+type TagPodcastData struct {
+	Title       string
+	Author      string
+	Description string
+	Link        string
+	FeedURL     string
+	GUID        string
+	Categories  []string
+	Keywords    string
+	Persons     []string
+	Funding     []PodcastingFunding
+	Locked      bool
+	LockedOwner string
+}
+
+// TagData are the episode fields available to the tag templates
+type TagData struct {
+	Title          string
+	Author         string
+	Description    string
+	Summary        string
+	Link           string
+	GUID           string
+	URL            string
+	File           string
+	EpisodeType    string
+	Number         string
+	Season         string
+	SeasonName     string
+	EpisodeDisplay string
+	Persons        []string
+	Hosts          []string
+	Guests         []string
+	Published      time.Time
+	PubDate        string
+	Duration       time.Duration
+	Explicit       bool
+	Keywords       string
+	MaxCommentSize int
+	DateFormat     string
+	Podcast        TagPodcastData
+}
+
+// tagTemplateFunctions are the helper functions of the tag templates, the piped value is the last argument
+var tagTemplateFunctions = template.FuncMap{
+	"truncate":    truncateRunes,
+	"stripPrefix": stripPrefix,
+	"replace":     replacePattern,
+	"date":        formatDate,
+	"text":        htmlText,
+	"default":     defaultValue,
+	"join":        func(separator string, values []string) string { return strings.Join(values, separator) },
+	"upper":       strings.ToUpper,
+	"lower":       strings.ToLower,
+	"trim":        strings.TrimSpace,
+}
+
+// truncateRunes cuts the value after max runes, a cut value ends with " ...", 0 means no limit
+func truncateRunes(max int, value string) string {
+	if max <= 0 || utf8.RuneCountInString(value) <= max {
+		return value
+	}
+	return strings.TrimSpace(string([]rune(value)[:max])) + " ..."
+}
+
+// stripPrefix removes the prefix from the value, ignoring the case
+func stripPrefix(prefix string, value string) string {
+	if len(value) >= len(prefix) && strings.EqualFold(value[:len(prefix)], prefix) {
+		return strings.TrimSpace(value[len(prefix):])
+	}
+	return value
+}
+
+// replacePattern replaces the matches of the regular expression, an invalid expression leaves the value unchanged
+func replacePattern(pattern string, replacement string, value string) string {
+	expression, err := regexp.Compile(pattern)
+	if err != nil {
+		logger.Warning.Println("Invalid tag template expression ignored : "+pattern, err)
+		return value
+	}
+	return expression.ReplaceAllString(value, replacement)
+}
+
+// formatDate formats the date with a Go time layout, an unknown date gives an empty value
+func formatDate(layout string, date time.Time) string {
+	if date.IsZero() {
+		return ""
+	}
+	return date.Format(layout)
+}
+
+func htmlText(value string) string {
+	text, err := html2text.FromString(value)
+	if err != nil {
+		return value
+	}
+	return text
+}
+
+func defaultValue(fallback string, value string) string {
+	if strings.TrimSpace(value) == "" {
+		return fallback
+	}
+	return value
+}
+
+// globalTagTemplates are the default tag templates overridden by the <tag>Template settings
+func globalTagTemplates() map[TagField]string {
+	templates := map[TagField]string{}
+	for _, field := range templateTagFields {
+		templates[field] = defaultTagTemplates[field]
+		if viper.IsSet(string(field) + "Template") {
+			templates[field] = viper.GetString(string(field) + "Template")
+		}
+	}
+	return templates
+}
+
+// overrideTagTemplates applies the tagTemplates of a feed, the keys are the tag names
+func overrideTagTemplates(templates map[TagField]string, overrides map[string]string) {
+	for name, value := range overrides {
+		found := false
+		for _, field := range templateTagFields {
+			if strings.EqualFold(name, string(field)) {
+				templates[field], found = value, true
+			}
+		}
+		if !found {
+			logger.Warning.Println("Unknown tag template ignored : " + name)
+		}
+	}
+}
+
+// parsedTemplates are the templates already parsed by name and text, an invalid template is kept as nil
+var parsedTemplates = struct {
+	sync.Mutex
+	templates map[string]*template.Template
+}{templates: map[string]*template.Template{}}
+
+// parseTemplate parses a template text once with the helper functions, an invalid template is reported on its first parsing and gives nil
+func parseTemplate(name string, text string, functions ...template.FuncMap) *template.Template {
+	parsedTemplates.Lock()
+	defer parsedTemplates.Unlock()
+	key := name + "\x00" + text
+	if parsed, found := parsedTemplates.templates[key]; found {
+		return parsed
+	}
+	parsed := template.New(name)
+	for _, function := range functions {
+		parsed = parsed.Funcs(function)
+	}
+	parsed, err := parsed.Parse(text)
+	if err != nil {
+		logger.Warning.Println("Invalid "+name+" template ignored : "+text, err)
+		parsed = nil
+	}
+	parsedTemplates.templates[key] = parsed
+	return parsed
+}
+
+// parseTagTemplates parses the tag templates, the tags with an invalid template are not written
+func parseTagTemplates(templates map[TagField]string) map[TagField]*template.Template {
+	parsed := map[TagField]*template.Template{}
+	for field, text := range templates {
+		parsed[field] = parseTemplate(string(field), text, tagTemplateFunctions)
+	}
+	return parsed
+}
+
+func firstLink(links []*rss.Link) string {
+	for _, link := range links {
+		if link != nil && link.Href != "" {
+			return link.Href
+		}
+	}
+	return ""
+}
+
+// newTagData gathers the episode and podcast fields for the tag templates
+func newTagData(episode *Episode) TagData {
+	podcast := episode.Podcast
+	season, number := episode.numbers()
+	data := TagData{
+		Title:          episode.feedEpisode.Title,
+		Author:         episode.author(),
+		Description:    episode.feedEpisode.Description,
+		Summary:        episode.summary(),
+		Link:           firstLink(episode.feedEpisode.Links),
+		GUID:           episodeGUID(episode.feedEpisode),
+		File:           episode.file(),
+		EpisodeType:    episode.episodeType(),
+		SeasonName:     episode.podcasting.SeasonName,
+		EpisodeDisplay: episode.podcasting.episodeNumber(),
+		Persons:        personNames(episode.persons(), ""),
+		Hosts:          personNames(episode.persons(), "host"),
+		Guests:         personNames(episode.persons(), "guest"),
+		PubDate:        episode.formattedPubDate(podcast.settings.DateFormat),
+		Duration:       episode.duration(),
+		Explicit:       episode.explicit(),
+		Keywords:       episode.keywords(),
+		MaxCommentSize: podcast.settings.MaxCommentSize,
+		DateFormat:     podcast.settings.DateFormat,
+		Podcast: TagPodcastData{
+			Title:       podcast.feedPodcast.Title,
+			Author:      podcast.author(),
+			Description: podcast.feedPodcast.Description,
+			FeedURL:     podcast.subscription.URL,
+			GUID:        podcast.podcasting.GUID,
+			Categories:  podcast.categories(),
+			Keywords:    itunesValue(podcast.feedPodcast.Extensions, "keywords"),
+			Persons:     personNames(podcast.podcasting.Persons, ""),
+			Funding:     podcast.podcasting.Funding,
+			Locked:      podcast.podcasting.Locked,
+			LockedOwner: podcast.podcasting.LockedOwner,
+		},
+	}
+	if data.Description == "" {
+		data.Description = data.Summary
+	}
+	if data.Podcast.Description == "" {
+		data.Podcast.Description = podcast.summary()
+	}
+	if season > 0 {
+		data.Season = strconv.Itoa(season)
+	}
+	if number > 0 {
+		data.Number = strconv.Itoa(number)
+	}
+	if episode.enclosure != nil {
+		data.URL = episode.enclosure.Url
+	}
+	if published, err := episode.feedEpisode.ParsedPubDate(); err == nil {
+		data.Published = published
+	}
+	for _, link := range podcast.feedPodcast.Links {
+		if link.Href != "" && data.Podcast.Link == "" {
+			data.Podcast.Link = link.Href
+		}
+	}
+	return data
+}
+
+// renderTagTemplate renders the parsed tag template with the episode fields, the surrounding spaces are removed
+func renderTagTemplate(parsed *template.Template, data TagData) (string, error) {
+	var buffer bytes.Buffer
+	if err := parsed.Execute(&buffer, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buffer.String()), nil
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 )
 
 func pathExists(path string) bool {
@@ -24,3 +26,58 @@ func copyFile(source string, target string) error {
 	}
 	return err
 }
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// writeFileAtomic replaces the file content through a temporary file so that a failure never leaves a truncated file
+func writeFileAtomic(path string, content []byte) error {
+	return writeFileAtomicWith(path, func(w io.Writer) error {
+		_, err := w.Write(content)
+		return err
+	})
+}
+
+// writeFileAtomicWith replaces the file content written by the write function through a temporary file
+func writeFileAtomicWith(path string, write func(w io.Writer) error) error {
+	mode := os.FileMode(0666)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode()
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer removeTempFile(tmp.Name())
+	err = write(tmp)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), mode)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	return err
+}
+
+// absolutePath is used to compare paths, the path is unchanged when it cannot be made absolute
+func absolutePath(path string) string {
+	if absolute, err := filepath.Abs(path); err == nil {
+		return absolute
+	}
+	return path
+}
+
+func exitOnError(message string, err error) {
+	if err != nil {
+		logger.Error.Fatalln(message+" : ", err)
+	}
+}
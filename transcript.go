@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jaytaylor/html2text"
+	"github.com/spf13/viper"
+)
+
+// SubRipSuffix is the suffix of the SRT transcript sidecar file
+const SubRipSuffix string = ".srt"
+
+// LyricsSuffix is the suffix of the LRC transcript sidecar file
+const LyricsSuffix string = ".lrc"
+
+// transcriptTypes are the supported transcript media types, the preferred one first
+var transcriptTypes = []string{"application/x-subrip", "application/srt", "text/vtt", "application/json", "text/html", "text/plain"}
+
+// TranscriptCue is a transcript segment, the untimed transcripts only have paragraphs without times
+type TranscriptCue struct {
+	Start   time.Duration
+	End     time.Duration
+	Speaker string
+	Text    string
+}
+
+// Transcript is an episode transcript normalized from one of the podcast:transcript formats
+type Transcript struct {
+	Language string
+	Timed    bool
+	Cues     []TranscriptCue
+}
+
+// podcastingTranscript is the JSON transcript format of the podcast namespace
+type podcastingTranscript struct {
+	Segments []struct {
+		Speaker   string  `json:"speaker"`
+		StartTime float64 `json:"startTime"`
+		EndTime   float64 `json:"endTime"`
+		Body      string  `json:"body"`
+	} `json:"segments"`
+}
+
+var (
+	cueTimesExpression = regexp.MustCompile(`^\s*([0-9:.,]+)\s*-->\s*([0-9:.,]+)`)
+	voiceExpression    = regexp.MustCompile(`^<v(?:\.[^ >]*)?\s+([^>]*)>`)
+	markupExpression   = regexp.MustCompile(`<[^>]*>`)
+)
+
+// transcriptType is the normalized media type of the transcript link, guessed from the url when the type is missing
+func transcriptType(link PodcastingTranscript) string {
+	mediaType := strings.ToLower(strings.TrimSpace(link.Type))
+	if mediaType == "" {
+		switch strings.ToLower(filepath.Ext(extractResourceNameFromURL(link.URL))) {
+		case ".srt":
+			mediaType = "application/srt"
+		case ".vtt":
+			mediaType = "text/vtt"
+		case ".json":
+			mediaType = "application/json"
+		case ".html", ".htm":
+			mediaType = "text/html"
+		case ".txt":
+			mediaType = "text/plain"
+		}
+	}
+	return mediaType
+}
+
+// preferredTranscript selects the transcript link with the most accurate supported format
+func preferredTranscript(links []PodcastingTranscript) (link PodcastingTranscript, found bool) {
+	rank := len(transcriptTypes)
+	for _, candidate := range links {
+		for i, mediaType := range transcriptTypes {
+			if i < rank && transcriptType(candidate) == mediaType {
+				link, found, rank = candidate, true, i
+			}
+		}
+	}
+	return link, found
+}
+
+// parseTranscript normalizes the transcript content of the given media type
+func parseTranscript(content []byte, mediaType string) (*Transcript, error) {
+	switch mediaType {
+	case "application/x-subrip", "application/srt", "text/vtt":
+		return parseTimedText(string(content)), nil
+	case "application/json":
+		return parseJSONTranscript(content)
+	case "text/html":
+		text, err := html2text.FromString(string(content))
+		if err != nil {
+			return nil, err
+		}
+		return parsePlainTranscript(text), nil
+	default:
+		return parsePlainTranscript(string(content)), nil
+	}
+}
+
+// parseCueTime reads a SRT (00:01:02,500) or WebVTT (01:02.500) cue time
+func parseCueTime(value string) (time.Duration, bool) {
+	seconds, ok := parseClockTime(strings.Replace(value, ",", ".", 1))
+	return time.Duration(seconds * float64(time.Second)), ok
+}
+
+// parseTimedText reads the cues of a SRT or WebVTT transcript, the WebVTT voice tags give the speakers
+func parseTimedText(content string) *Transcript {
+	transcript := &Transcript{Timed: true}
+	content = strings.Replace(strings.Replace(content, "\r\n", "\n", -1), "\r", "\n", -1)
+	for _, block := range strings.Split(content, "\n\n") {
+		lines := strings.Split(strings.Trim(block, "\n"), "\n")
+		for i, line := range lines {
+			times := cueTimesExpression.FindStringSubmatch(line)
+			if times == nil {
+				continue
+			}
+			start, startOk := parseCueTime(times[1])
+			end, endOk := parseCueTime(times[2])
+			if !startOk || !endOk {
+				break
+			}
+			cue := TranscriptCue{Start: start, End: end}
+			var text []string
+			for _, textLine := range lines[i+1:] {
+				if voice := voiceExpression.FindStringSubmatch(textLine); voice != nil {
+					cue.Speaker = strings.TrimSpace(voice[1])
+				}
+				if textLine = strings.TrimSpace(markupExpression.ReplaceAllString(textLine, "")); textLine != "" {
+					text = append(text, textLine)
+				}
+			}
+			cue.Text = strings.Join(text, " ")
+			if cue.Text != "" {
+				transcript.Cues = append(transcript.Cues, cue)
+			}
+			break
+		}
+	}
+	return transcript
+}
+
+// parseJSONTranscript reads a podcast namespace JSON transcript, the consecutive segments of a speaker are joined into sentences
+func parseJSONTranscript(content []byte) (*Transcript, error) {
+	var segments podcastingTranscript
+	if err := json.Unmarshal(content, &segments); err != nil {
+		return nil, err
+	}
+	transcript := &Transcript{Timed: true}
+	for _, segment := range segments.Segments {
+		body := strings.TrimSpace(segment.Body)
+		if body == "" {
+			continue
+		}
+		start := time.Duration(segment.StartTime * float64(time.Second))
+		end := time.Duration(segment.EndTime * float64(time.Second))
+		if last := len(transcript.Cues) - 1; last >= 0 {
+			cue := &transcript.Cues[last]
+			if cue.Speaker == segment.Speaker && start-cue.End < time.Second && end-cue.Start < 10*time.Second && !strings.ContainsAny(cue.Text[len(cue.Text)-1:], ".?!") {
+				cue.Text += " " + body
+				cue.End = end
+				continue
+			}
+		}
+		transcript.Cues = append(transcript.Cues, TranscriptCue{Start: start, End: end, Speaker: segment.Speaker, Text: body})
+	}
+	return transcript, nil
+}
+
+// parsePlainTranscript reads an untimed transcript, one cue by paragraph
+func parsePlainTranscript(content string) *Transcript {
+	transcript := &Transcript{}
+	content = strings.Replace(content, "\r\n", "\n", -1)
+	for _, paragraph := range strings.Split(content, "\n\n") {
+		if text := strings.Join(strings.Fields(paragraph), " "); text != "" {
+			transcript.Cues = append(transcript.Cues, TranscriptCue{Text: text})
+		}
+	}
+	return transcript
+}
+
+func (cue TranscriptCue) line() string {
+	if cue.Speaker != "" {
+		return cue.Speaker + ": " + cue.Text
+	}
+	return cue.Text
+}
+
+func subRipTime(d time.Duration) string {
+	milliseconds := int64(d / time.Millisecond)
+	return fmt.Sprintf("%02d:%02d:%02d,%03d", milliseconds/3600000, milliseconds/60000%60, milliseconds/1000%60, milliseconds%1000)
+}
+
+func lyricsTime(d time.Duration) string {
+	centiseconds := int64(d / (10 * time.Millisecond))
+	return fmt.Sprintf("[%02d:%02d.%02d]", centiseconds/6000, centiseconds/100%60, centiseconds%100)
+}
+
+// subRip formats the transcript as SRT, an untimed transcript is a single cue lasting the whole episode
+func (transcript *Transcript) subRip(length time.Duration) string {
+	if !transcript.Timed {
+		var lines []string
+		for _, cue := range transcript.Cues {
+			lines = append(lines, cue.line())
+		}
+		return "1\n" + subRipTime(0) + " --> " + subRipTime(length) + "\n" + strings.Join(lines, "\n") + "\n"
+	}
+	var blocks []string
+	for i, cue := range transcript.Cues {
+		blocks = append(blocks, strconv.Itoa(i+1)+"\n"+subRipTime(cue.Start)+" --> "+subRipTime(cue.End)+"\n"+cue.line()+"\n")
+	}
+	return strings.Join(blocks, "\n")
+}
+
+// lyrics formats the transcript as LRC, the lines of an untimed transcript all start at the beginning of the episode
+func (transcript *Transcript) lyrics(episode *Episode) string {
+	lines := []string{
+		"[ar:" + episode.Podcast.feedPodcast.Title + "]",
+		"[ti:" + episode.feedEpisode.Title + "]",
+	}
+	for _, cue := range transcript.Cues {
+		lines = append(lines, lyricsTime(cue.Start)+cue.line())
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// episodeTranscript downloads and normalizes the preferred podcast:transcript of the episode, nil when the episode has none
+func episodeTranscript(episode *Episode) (*Transcript, error) {
+	link, found := preferredTranscript(episode.podcasting.Transcripts)
+	if !found {
+		if len(episode.podcasting.Transcripts) > 0 {
+			logger.Debug.Println("Unsupported transcript types ignored : " + episode.String())
+		}
+		return nil, nil
+	}
+	content, _, err := fetchResource(link.URL, episode.Podcast.client)
+	if err != nil {
+		return nil, err
+	}
+	transcript, err := parseTranscript(content, transcriptType(link))
+	if err != nil {
+		return nil, err
+	}
+	transcript.Language = link.Language
+	return transcript, nil
+}
+
+// writeTranscript writes the episode transcript next to the episode file as SRT and LRC,
+// the ID3v2 tag of a mp3 file also gets USLT and SYLT frames, saved with the other tags, when transcriptTags is set
+func writeTranscript(episode *Episode, tag tagFile, length time.Duration) {
+	if !viper.GetBool("transcripts") {
+		return
+	}
+	transcript, err := episodeTranscript(episode)
+	if err != nil {
+		logger.Warning.Println("Cannot read the transcript of "+episode.String(), err)
+		return
+	}
+	if transcript == nil || len(transcript.Cues) == 0 {
+		return
+	}
+	if length == 0 {
+		length = episode.duration()
+	}
+	file := episode.file()
+	err = writeFileAtomic(sidecarPath(file, SubRipSuffix), []byte(transcript.subRip(length)))
+	if err == nil {
+		err = writeFileAtomic(sidecarPath(file, LyricsSuffix), []byte(transcript.lyrics(episode)))
+	}
+	if id3, ok := tag.(*id3File); ok && err == nil && viper.GetBool("transcriptTags") && strings.EqualFold(filepath.Ext(file), ".mp3") {
+		setID3Transcript(id3.tag, transcript)
+	}
+	if err != nil {
+		logger.Warning.Println("Cannot write the transcript of "+episode.String(), err)
+		return
+	}
+	logger.Debug.Println("Transcript written for " + episode.String())
+}
+
+// id3Language is the ISO-639-2 language code of the lyrics frames, XXX when the transcript language is not one
+func id3Language(language string) []byte {
+	if len(language) == 3 {
+		return []byte(strings.ToLower(language))
+	}
+	return []byte("XXX")
+}
+
+// setID3Transcript replaces the USLT and SYLT frames of the ID3v2 tag, the SYLT frame is only written for a timed transcript
+func setID3Transcript(tag *id3Tag, transcript *Transcript) {
+	tag.removeFrames("USLT", "SYLT")
+	var lines []string
+	for _, cue := range transcript.Cues {
+		lines = append(lines, cue.line())
+	}
+	unsynchronised := append([]byte{tag.textEncoding()}, id3Language(transcript.Language)...)
+	unsynchronised = append(unsynchronised, tag.encodeString("", true)...)
+	tag.addFrame("USLT", append(unsynchronised, tag.encodeString(strings.Join(lines, "\n"), false)...))
+	if !transcript.Timed {
+		return
+	}
+	synchronised := append([]byte{tag.textEncoding()}, id3Language(transcript.Language)...)
+	synchronised = append(synchronised, 2, 1)
+	synchronised = append(synchronised, tag.encodeString("", true)...)
+	timestamp := make([]byte, 4)
+	for _, cue := range transcript.Cues {
+		synchronised = append(synchronised, tag.encodeString(cue.line(), true)...)
+		binary.BigEndian.PutUint32(timestamp, uint32(cue.Start/time.Millisecond))
+		synchronised = append(synchronised, timestamp...)
+	}
+	tag.addFrame("SYLT", synchronised)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// TrashFolder is the folder, in the target folder, where the removed episodes are moved
+const TrashFolder string = ".trash"
+
+// TrashMetaSuffix is the suffix of the metadata file written next to a trashed episode
+const TrashMetaSuffix string = ".trash.json"
+
+// TrashDateFormat is the name format of the daily trash folders
+const TrashDateFormat string = "2006-01-02"
+
+// TrashEntry is the metadata of a trashed episode
+type TrashEntry struct {
+	Path      string    `json:"path"`
+	Podcast   string    `json:"podcast,omitempty"`
+	Title     string    `json:"title,omitempty"`
+	Feed      string    `json:"feed,omitempty"`
+	Reason    string    `json:"reason"`
+	TrashedAt time.Time `json:"trashedAt"`
+	file      string
+}
+
+func trashFolder() string {
+	return filepath.Join(targetFolder, TrashFolder)
+}
+
+// moveToTrash moves the episode file into the trash folder of the day with its metadata
+func moveToTrash(path string, reason string) error {
+	entry := TrashEntry{Path: absolutePath(path), Reason: reason, TrashedAt: time.Now()}
+	if record, found := states.recordsByPath()[entry.Path]; found {
+		entry.Podcast = record.Podcast
+		entry.Title = record.Title
+		entry.Feed = record.Feed
+	}
+	folder := filepath.Join(trashFolder(), entry.TrashedAt.Format(TrashDateFormat), filepath.Base(filepath.Dir(path)))
+	if err := os.MkdirAll(folder, 0777); err != nil {
+		return err
+	}
+	target := filepath.Join(folder, filepath.Base(path))
+	for i := 1; pathExists(target); i++ {
+		target = filepath.Join(folder, strconv.Itoa(i)+"-"+filepath.Base(path))
+	}
+	metadata, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(path, target); err != nil {
+		return err
+	}
+	if err = moveSidecars(path, target); err != nil {
+		return err
+	}
+	return writeFileAtomic(target+TrashMetaSuffix, metadata)
+}
+
+// trashEntries lists the trashed episodes, the oldest first
+func trashEntries() []TrashEntry {
+	var entries []TrashEntry
+	filepath.Walk(trashFolder(), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(path, TrashMetaSuffix) {
+			return nil
+		}
+		content, err := ioutil.ReadFile(path)
+		var entry TrashEntry
+		if err != nil || json.Unmarshal(content, &entry) != nil {
+			logger.Warning.Println("Invalid trash metadata ignored : " + path)
+			return nil
+		}
+		entry.file = strings.TrimSuffix(path, TrashMetaSuffix)
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries
+}
+
+func (entry TrashEntry) date() string {
+	return entry.TrashedAt.Format(TrashDateFormat)
+}
+
+// matches tells if the trashed episode is selected by its trash date, its file name or its path
+func (entry TrashEntry) matches(selector string) bool {
+	return selector == entry.date() ||
+		selector == filepath.Base(entry.Path) ||
+		absolutePath(selector) == entry.Path ||
+		absolutePath(selector) == absolutePath(entry.file)
+}
+
+func (entry TrashEntry) restore() error {
+	if pathExists(entry.Path) {
+		return errors.New("Cannot restore " + entry.file + ", the file already exists : " + entry.Path)
+	}
+	if err := os.MkdirAll(filepath.Dir(entry.Path), 0777); err != nil {
+		return err
+	}
+	if err := os.Rename(entry.file, entry.Path); err != nil {
+		return err
+	}
+	if err := moveSidecars(entry.file, entry.Path); err != nil {
+		return err
+	}
+	states.markRestored(entry.Path)
+	return os.Remove(entry.file + TrashMetaSuffix)
+}
+
+func (entry TrashEntry) remove() error {
+	for _, file := range append(sidecarFiles(entry.file), entry.file) {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Remove(entry.file + TrashMetaSuffix)
+}
+
+// purgeTrash removes the episodes trashed for longer than the trash retention
+func purgeTrash() {
+	retention := parseKeepAge(viper.GetString("trashRetention"))
+	if retention == 0 {
+		return
+	}
+	for _, entry := range trashEntries() {
+		if time.Since(entry.TrashedAt) > retention {
+			logger.Debug.Println("Purge the trashed episode : " + entry.file)
+			if err := entry.remove(); err != nil {
+				logger.Warning.Println("Cannot purge the trashed episode "+entry.file, err)
+			}
+		}
+	}
+	removeEmptyFolders(trashFolder())
+}
+
+// removeEmptyFolders removes the empty sub folders of the folder
+func removeEmptyFolders(folder string) {
+	files, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			subFolder := filepath.Join(folder, f.Name())
+			removeEmptyFolders(subFolder)
+			if content, err := ioutil.ReadDir(subFolder); err == nil && len(content) == 0 {
+				os.Remove(subFolder)
+			}
+		}
+	}
+}
+
+func newTrashCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "trash",
+		Short: "Manage the removed episodes",
+		Long: `The episodes removed by the retention policies are moved to <target folder>/.trash/<removal date>/<episode folder name>
+with their metadata, they are purged after trashRetention.`,
+	}
+	cmd.AddCommand(
+		&cobra.Command{
+			Use:   "list",
+			Short: "List the trashed episodes",
+			Long:  `List the trashed episodes as tab separated lines : trash date, podcast, episode title, reason and original path`,
+			Args:  cobra.NoArgs,
+			Run: func(cmd *cobra.Command, args []string) {
+				for _, entry := range trashEntries() {
+					logger.Info.Println(strings.Join([]string{entry.date(), entry.Podcast, entry.Title, entry.Reason, entry.Path}, "\t"))
+				}
+			},
+		},
+		&cobra.Command{
+			Use:   "restore <date|file>...",
+			Short: "Restore trashed episodes",
+			Long:  `Move the trashed episodes back to their podcast folder, selected by trash date (YYYY-MM-DD), file name or path`,
+			Args:  cobra.MinimumNArgs(1),
+			Run: func(cmd *cobra.Command, args []string) {
+				exitOnError("Cannot restore the episodes", restoreTrash(args))
+			},
+		},
+		&cobra.Command{
+			Use:   "empty",
+			Short: "Remove all the trashed episodes",
+			Args:  cobra.NoArgs,
+			Run: func(cmd *cobra.Command, args []string) {
+				exitOnError("Cannot empty the trash", emptyTrash())
+			},
+		},
+	)
+	return cmd
+}
+
+func restoreTrash(selectors []string) error {
+	var err error
+	states, err = OpenStateStore(stateDatabasePath())
+	if err != nil {
+		return err
+	}
+	defer states.Close()
+
+	restored := 0
+	for _, entry := range trashEntries() {
+		for _, selector := range selectors {
+			if entry.matches(selector) {
+				if err = entry.restore(); err != nil {
+					return err
+				}
+				logger.Info.Println("Episode restored : " + entry.Path)
+				restored++
+				break
+			}
+		}
+	}
+	removeEmptyFolders(trashFolder())
+	if restored == 0 {
+		return errors.New("No trashed episode found for " + strings.Join(selectors, ", "))
+	}
+	return nil
+}
+
+func emptyTrash() error {
+	for _, entry := range trashEntries() {
+		if err := entry.remove(); err != nil {
+			return err
+		}
+	}
+	removeEmptyFolders(trashFolder())
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+)
+
+// QuarantineFolder is the folder, in the target folder, where the rejected downloads are moved
+const QuarantineFolder string = ".quarantine"
+
+// ExpectedResource is the resource announced by the feed, used to validate a download before accepting it
+type ExpectedResource struct {
+	Type   string
+	Length int64
+}
+
+// DownloadValidationError is the reason why a download has been rejected
+type DownloadValidationError struct {
+	Reason string
+}
+
+func (e *DownloadValidationError) Error() string {
+	return "Invalid download : " + e.Reason
+}
+
+func rejectDownload(reason string) error {
+	return &DownloadValidationError{Reason: reason}
+}
+
+// downloadResult describes the downloaded content
+type downloadResult struct {
+	size        int64
+	length      int64
+	contentType string
+}
+
+func (expected *ExpectedResource) validate(tmpFilename string, result downloadResult) error {
+	info, err := os.Stat(tmpFilename)
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(result.contentType, ";")[0]))
+	if isDocumentType(mediaType) && isMediaType(expected.Type) {
+		return rejectDownload("content type " + mediaType + " instead of " + expected.Type)
+	}
+	if result.length > 0 && size != result.length {
+		return rejectDownload("size " + strconv.FormatInt(size, 10) + " instead of the announced content length " + strconv.FormatInt(result.length, 10))
+	}
+	header := make([]byte, 16)
+	file, err := os.Open(tmpFilename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	n, _ := io.ReadFull(file, header)
+	header = header[:n]
+
+	format := sniffFormat(header)
+	if format == "html" || format == "xml" {
+		return rejectDownload("the content is a " + format + " document")
+	}
+	if strings.HasPrefix(strings.ToLower(expected.Type), "audio") && format == "" {
+		return rejectDownload("unknown audio format (content type " + mediaType + ")")
+	}
+	// the enclosure lengths of the feeds are often wrong, the length only matters when the format is unknown
+	if format == "" && expected.Length > 0 && size*2 < expected.Length {
+		return rejectDownload("size " + bytefmt.ByteSize(uint64(size)) + " much smaller than the enclosure length " + bytefmt.ByteSize(uint64(expected.Length)))
+	}
+	logger.Debug.Println("Download validated : " + tmpFilename + " (" + format + ")")
+	return nil
+}
+
+func isMediaType(mediaType string) bool {
+	mediaType = strings.ToLower(mediaType)
+	return strings.HasPrefix(mediaType, "audio") || strings.HasPrefix(mediaType, "video")
+}
+
+func isDocumentType(mediaType string) bool {
+	return strings.HasPrefix(mediaType, "text/") ||
+		mediaType == "application/xhtml+xml" ||
+		mediaType == "application/json" ||
+		mediaType == "application/xml"
+}
+
+// sniffFormat detects the file format from its first bytes
+func sniffFormat(header []byte) string {
+	trimmed := bytes.ToLower(bytes.TrimSpace(header))
+	switch {
+	case bytes.HasPrefix(header, []byte("ID3")):
+		return "id3"
+	case len(header) >= 2 && header[0] == 0xFF && header[1]&0xF6 == 0xF0:
+		return "aac"
+	case len(header) >= 2 && header[0] == 0xFF && header[1]&0xE0 == 0xE0:
+		return "mp3"
+	case bytes.HasPrefix(header, []byte("OggS")):
+		return "ogg"
+	case len(header) >= 8 && bytes.Equal(header[4:8], []byte("ftyp")):
+		return "mp4"
+	case bytes.HasPrefix(header, []byte("fLaC")):
+		return "flac"
+	case bytes.HasPrefix(header, []byte("ADIF")):
+		return "aac"
+	case len(header) >= 12 && bytes.HasPrefix(header, []byte("RIFF")) && bytes.Equal(header[8:12], []byte("WAVE")):
+		return "wav"
+	case bytes.HasPrefix(header, []byte("FORM")):
+		return "aiff"
+	case bytes.HasPrefix(header, []byte{0x30, 0x26, 0xB2, 0x75}):
+		return "asf"
+	case bytes.HasPrefix(header, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		return "matroska"
+	case bytes.HasPrefix(trimmed, []byte("<!doctype")) || bytes.HasPrefix(trimmed, []byte("<html")):
+		return "html"
+	case bytes.HasPrefix(trimmed, []byte("<?xml")):
+		return "xml"
+	}
+	return ""
+}
+
+// quarantine moves the rejected download into the quarantine folder with the rejection reason
+func quarantine(tmpFilename string, folder string, uri string, reason error) {
+	quarantineFolder := filepath.Join(targetFolder, QuarantineFolder, quarantineSubfolder(folder))
+	target := filepath.Join(quarantineFolder, strings.TrimSuffix(filepath.Base(tmpFilename), PartialSuffix))
+	removeTempFile(tmpFilename + PartialMetaSuffix)
+	err := os.MkdirAll(quarantineFolder, 0777)
+	if err == nil {
+		err = os.Rename(tmpFilename, target)
+	}
+	if err == nil {
+		content := "url: " + uri + "\nreason: " + reason.Error() + "\ndate: " + time.Now().Format(time.RFC3339) + "\n"
+		err = writeFileAtomic(target+".reason.txt", []byte(content))
+	}
+	if err != nil {
+		logger.Error.Println("Cannot quarantine the rejected download "+tmpFilename, err)
+		removeTempFile(tmpFilename)
+		return
+	}
+	logger.Warning.Println("Rejected download moved to " + target + " : " + reason.Error())
+}
+
+// quarantineSubfolder is the folder path in the library, the sub folders of the file template are kept and the folders outside the library use their name
+func quarantineSubfolder(folder string) string {
+	relativePath, err := filepath.Rel(absolutePath(targetFolder), absolutePath(folder))
+	if err != nil || relativePath == ".." || strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
+		return filepath.Base(folder)
+	}
+	return relativePath
+}